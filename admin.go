@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminToken is the bearer token that the administrative endpoints require. They are
+// disabled if it is not set.
+var adminToken string
+
+func authorizeAdmin(writer http.ResponseWriter, request *http.Request) bool {
+	expected := "Bearer " + adminToken
+	authorization := request.Header.Get("Authorization")
+
+	if subtle.ConstantTimeCompare([]byte(authorization), []byte(expected)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(401)
+		fmt.Fprintln(writer, "Unauthorized")
+		log.Println("Unauthorized admin request:", request.Method, request.URL.Path)
+		return false
+	}
+
+	return true
+}
+
+// tombstonesHandler serves /admin/tombstones/[<app>/]<environment>/<device-token>, where
+// GET shows the tombstone for a device token and DELETE removes it, so that pushes to
+// it are sent to APNs again.
+func tombstonesHandler(writer http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(writer, request) {
+		return
+	}
+
+	components := strings.Split(strings.TrimPrefix(request.URL.Path, "/admin/tombstones/"), "/")
+
+	a := defaultApp
+	if len(components) == 3 {
+		a = apps[components[0]]
+		components = components[1:]
+	}
+
+	if a == nil || len(components) != 2 || components[1] == "" {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Invalid URL path:", request.URL.Path)
+		return
+	}
+
+	key := tombstoneKey(a, components[0], components[1])
+
+	switch request.Method {
+	case "GET":
+		stone, ok := tombstones.Get(key)
+		if !ok {
+			writer.WriteHeader(404)
+			fmt.Fprintln(writer, "No tombstone for", key)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(stone)
+	case "DELETE":
+		if !tombstones.Delete(key) {
+			writer.WriteHeader(404)
+			fmt.Fprintln(writer, "No tombstone for", key)
+			return
+		}
+
+		writer.WriteHeader(204)
+		log.Println("Cleared tombstone for", key)
+	default:
+		writer.Header().Set("Allow", "GET, DELETE")
+		writer.WriteHeader(405)
+	}
+}
+
+// deadLettersHandler serves the dead letter endpoints:
+//
+//	GET    /admin/dead-letters             lists all dead letters
+//	POST   /admin/dead-letters/replay      replays all dead letters
+//	DELETE /admin/dead-letters             purges all dead letters
+//	GET    /admin/dead-letters/<id>        shows a dead letter with its payload
+//	POST   /admin/dead-letters/<id>/replay replays a dead letter
+//	DELETE /admin/dead-letters/<id>        purges a dead letter
+func deadLettersHandler(writer http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(writer, request) {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/admin/dead-letters"), "/")
+	components := strings.Split(path, "/")
+
+	switch {
+	case path == "" && request.Method == "GET":
+		letters, err := deadLetters.List()
+		if err != nil {
+			writer.WriteHeader(500)
+			fmt.Fprintln(writer, "Error listing dead letters:", err)
+			log.Println("Error listing dead letters:", err)
+			return
+		}
+
+		type summary struct {
+			ID          string    `json:"id"`
+			App         string    `json:"app"`
+			Environment string    `json:"environment"`
+			DeviceToken string    `json:"device_token"`
+			StatusCode  int       `json:"status_code,omitempty"`
+			Reason      string    `json:"reason"`
+			Attempts    int       `json:"attempts"`
+			Received    time.Time `json:"received"`
+			Failed      time.Time `json:"failed"`
+		}
+
+		summaries := make([]summary, 0, len(letters))
+		for _, letter := range letters {
+			summaries = append(summaries, summary{
+				ID:          letter.Message.ID,
+				App:         letter.Message.App,
+				Environment: letter.Message.Environment,
+				DeviceToken: letter.Message.DeviceToken,
+				StatusCode:  letter.StatusCode,
+				Reason:      letter.Reason,
+				Attempts:    letter.Attempts,
+				Received:    letter.Message.Received,
+				Failed:      letter.Failed,
+			})
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(summaries)
+	case path == "" && request.Method == "DELETE":
+		letters, _ := deadLetters.List()
+		for _, letter := range letters {
+			deadLetters.Delete(letter.Message.ID)
+		}
+
+		writer.WriteHeader(204)
+		log.Printf("Purged %d dead letters\n", len(letters))
+	case path == "replay" && request.Method == "POST":
+		letters, _ := deadLetters.List()
+		replayed := 0
+		for _, letter := range letters {
+			if deadLetters.replay(letter) {
+				replayed++
+			}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]int{"replayed": replayed, "failed": len(letters) - replayed})
+	case len(components) == 1 || (len(components) == 2 && components[1] == "replay"):
+		letter, ok := deadLetters.Get(components[0])
+		if !ok {
+			writer.WriteHeader(404)
+			fmt.Fprintln(writer, "No dead letter", components[0])
+			return
+		}
+
+		switch {
+		case len(components) == 2 && request.Method == "POST":
+			if !deadLetters.replay(letter) {
+				writer.WriteHeader(502)
+				fmt.Fprintln(writer, "Replay failed")
+				return
+			}
+			writer.WriteHeader(202)
+		case len(components) == 1 && request.Method == "GET":
+			writer.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(writer).Encode(letter)
+		case len(components) == 1 && request.Method == "DELETE":
+			deadLetters.Delete(letter.Message.ID)
+			writer.WriteHeader(204)
+			log.Println("Purged dead letter", letter.Message.ID)
+		default:
+			writer.WriteHeader(405)
+		}
+	default:
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Invalid URL path:", request.URL.Path)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/certificate"
+	"github.com/sideshow/apns2/token"
+)
+
+// Ways to handle payloads too large for APNs, as set by OVERSIZE.
+const (
+	oversizeOffload = "offload"
+	oversizeSplit   = "split"
+)
+
+// app is a profile for one app that pushes are relayed to, with its own APNs topic,
+// credentials and payload settings.
+type app struct {
+	name  string
+	topic string
+	alert string
+	sound string
+	hosts []string
+
+	// oversize is how payloads too large for APNs are handled: by offloading the body for
+	// the client to fetch, or by splitting it across several notifications.
+	oversize string
+
+	// stormMode is how storms of pushes to a device are handled once more than stormLimit
+	// alerting notifications have been sent to it within stormWindow.
+	stormMode   string
+	stormLimit  int
+	stormWindow time.Duration
+
+	developmentClient *apns2.Client
+	productionClient  *apns2.Client
+}
+
+var (
+	defaultApp *app
+	apps       map[string]*app
+)
+
+// loadApps sets up the default app, configured by unprefixed environment variables,
+// and any additional apps listed in APPS. Each additional app is configured by the
+// same variables as the default app, prefixed by its upper-cased name, such as
+// BETA_TOPIC for the app "beta". Apps without credentials of their own share those
+// of the default app.
+func loadApps(rootCAs *x509.CertPool) {
+	defaultApp = loadApp("", rootCAs, nil)
+
+	apps = make(map[string]*app)
+	for _, name := range strings.Split(env("APPS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if name == "production" || name == "development" || backendNames[name] {
+			log.Fatalf("App name %s is reserved\n", name)
+		}
+
+		apps[name] = loadApp(name, rootCAs, defaultApp)
+	}
+}
+
+func loadApp(name string, rootCAs *x509.CertPool, fallback *app) *app {
+	prefix := ""
+	filename := "toot-relay"
+	if name != "" {
+		prefix = strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+		filename += "-" + name
+	}
+
+	a := &app{
+		name:  name,
+		topic: env(prefix+"TOPIC", "cx.c3.toot"),
+		alert: env(prefix+"ALERT", "🎺"),
+		sound: env(prefix+"SOUND", ""),
+
+		oversize: env(prefix+"OVERSIZE", oversizeOffload),
+
+		stormMode:   env(prefix+"STORM_MODE", stormOff),
+		stormLimit:  envInt(prefix+"STORM_LIMIT", 10),
+		stormWindow: envDuration(prefix+"STORM_WINDOW", time.Minute),
+	}
+
+	switch a.oversize {
+	case oversizeOffload, oversizeSplit:
+	default:
+		log.Fatalf("Unknown %sOVERSIZE %s\n", prefix, a.oversize)
+	}
+
+	switch a.stormMode {
+	case stormOff, stormCoalesce, stormSilent:
+	default:
+		log.Fatalf("Unknown %sSTORM_MODE %s\n", prefix, a.stormMode)
+	}
+
+	if fallback != nil {
+		if _, isPresent := os.LookupEnv(prefix + "TOPIC"); !isPresent {
+			log.Fatalf("%sTOPIC must be set for app %s\n", prefix, name)
+		}
+	}
+
+	for _, host := range strings.Split(env(prefix+"HOSTS", ""), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			a.hosts = append(a.hosts, host)
+		}
+	}
+
+	if fallback != nil && !hasCredentials(prefix) {
+		a.developmentClient = fallback.developmentClient
+		a.productionClient = fallback.productionClient
+		return a
+	}
+
+	p12file := env(prefix+"P12_FILENAME", filename+".p12")
+	p12base64 := env(prefix+"P12_BASE64", "")
+	p12password := env(prefix+"P12_PASSWORD", "")
+	// APNS_AUTH selects between certificate based authentication using the p12 file, and
+	// token based authentication using a .p8 auth key with its key ID and team ID. It
+	// defaults to token based authentication if a key ID is given.
+	p8file := env(prefix+"P8_FILENAME", filename+".p8")
+	p8base64 := env(prefix+"P8_BASE64", "")
+	keyID := env(prefix+"KEY_ID", "")
+	teamID := env(prefix+"TEAM_ID", "")
+	apnsAuth := "certificate"
+	if keyID != "" {
+		apnsAuth = "token"
+	}
+	apnsAuth = env(prefix+"APNS_AUTH", apnsAuth)
+
+	switch apnsAuth {
+	case "certificate":
+		var cert tls.Certificate
+		if p12base64 != "" {
+			bytes, err := base64.StdEncoding.DecodeString(p12base64)
+			if err != nil {
+				log.Fatal("Base64 decoding error: ", err)
+			}
+
+			cert, err = certificate.FromP12Bytes(bytes, p12password)
+			if err != nil {
+				log.Fatal("Error parsing certificate: ", err)
+			}
+		} else {
+			var err error
+			cert, err = certificate.FromP12File(p12file, p12password)
+			if err != nil {
+				log.Fatal("Error loading certificate file: ", err)
+			}
+		}
+
+		a.developmentClient = apns2.NewClient(cert).Development()
+		a.productionClient = apns2.NewClient(cert).Production()
+	case "token":
+		var authKey *ecdsa.PrivateKey
+		if p8base64 != "" {
+			bytes, err := base64.StdEncoding.DecodeString(p8base64)
+			if err != nil {
+				log.Fatal("Base64 decoding error: ", err)
+			}
+
+			authKey, err = token.AuthKeyFromBytes(bytes)
+			if err != nil {
+				log.Fatal("Error parsing auth key: ", err)
+			}
+		} else {
+			var err error
+			authKey, err = token.AuthKeyFromFile(p8file)
+			if err != nil {
+				log.Fatal("Error loading auth key file: ", err)
+			}
+		}
+
+		if keyID == "" || teamID == "" {
+			log.Fatalf("%sKEY_ID and %sTEAM_ID must be set for token based authentication\n", prefix, prefix)
+		}
+
+		// The token is regenerated by the clients before it expires, and is shared so that
+		// the development and production clients do not both have to.
+		authToken := &token.Token{
+			AuthKey: authKey,
+			KeyID:   keyID,
+			TeamID:  teamID,
+		}
+
+		a.developmentClient = apns2.NewTokenClient(authToken).Development()
+		a.productionClient = apns2.NewTokenClient(authToken).Production()
+	default:
+		log.Fatalf("Unknown %sAPNS_AUTH %s\n", prefix, apnsAuth)
+	}
+
+	if rootCAs != nil {
+		setRootCAs(a.developmentClient, rootCAs)
+		setRootCAs(a.productionClient, rootCAs)
+	}
+
+	return a
+}
+
+func hasCredentials(prefix string) bool {
+	for _, name := range []string{"APNS_AUTH", "P12_FILENAME", "P12_BASE64", "P8_FILENAME", "P8_BASE64", "KEY_ID"} {
+		if _, isPresent := os.LookupEnv(prefix + name); isPresent {
+			return true
+		}
+	}
+	return false
+}
+
+// appForHost returns the app whose HOSTS include the host name a request was sent to,
+// or the default app if there is none.
+func appForHost(host string) *app {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+
+	for _, a := range apps {
+		for _, h := range a.hosts {
+			if h == host {
+				return a
+			}
+		}
+	}
+
+	return defaultApp
+}
+
+func (a *app) client(environment string) *apns2.Client {
+	if environment == "production" {
+		return a.productionClient
+	}
+	return a.developmentClient
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/token"
+)
+
+// minTokenAge is how old a provider token must be before it is replaced because APNs
+// reports it as expired, as APNs rejects tokens that are replaced more often than every
+// 20 minutes with TooManyProviderTokenUpdates.
+const minTokenAge = 20 * time.Minute
+
+// backend sends messages to devices through a push service. Results are reported as
+// APNs responses, with failures given by the APNs reason that matches them best, so that
+// they are retried, recorded and reported to push senders in the same way whatever the
+// push service.
+type backend interface {
+	push(m *message) (*apns2.Response, error)
+}
+
+// Environments that select a backend other than APNs, in place of production or
+// development. These names cannot be used for apps.
+const (
+	environmentFCM         = "fcm"
+	environmentUnifiedPush = "unifiedpush"
+	environmentWebhook     = "webhook"
+	environmentStream      = "stream"
+)
+
+var (
+	// backendNames are the environments that select other backends, whether they are
+	// configured or not.
+	backendNames = map[string]bool{
+		environmentFCM:         true,
+		environmentUnifiedPush: true,
+		environmentWebhook:     true,
+		environmentStream:      true,
+	}
+
+	// backends are the configured backends, by the environment that selects them.
+	backends = make(map[string]backend)
+)
+
+// backendFor returns the backend for an environment, and false if it selects a backend
+// that is not configured. All other environments are APNs environments.
+func backendFor(environment string) (backend, bool) {
+	if b, ok := backends[environment]; ok {
+		return b, true
+	}
+
+	if backendNames[environment] {
+		return nil, false
+	}
+
+	return apnsBackend{}, true
+}
+
+// offloadsBodies returns whether the backend for an environment sends notifications too
+// small for some bodies, which are then offloaded for the client to fetch. The others
+// send the whole body.
+func offloadsBodies(environment string) bool {
+	switch environment {
+	case environmentUnifiedPush, environmentWebhook, environmentStream:
+		return false
+	default:
+		return true
+	}
+}
+
+// apnsBackend sends messages through APNs, with the credentials of their apps.
+type apnsBackend struct{}
+
+// push sends a message to APNs. A message that was split into fragments is sent as one
+// notification per fragment, and delivery stops at the first one that fails.
+func (apnsBackend) push(m *message) (*apns2.Response, error) {
+	client := m.app().client(m.Environment)
+
+	var res *apns2.Response
+	for _, notification := range m.notifications() {
+		issuedAt := tokenIssuedAt(client.Token)
+
+		var err error
+		res, err = client.Push(notification)
+		if err != nil {
+			pushAttempts.Add("error", 1)
+			log.Println("Push error:", err)
+			return nil, err
+		}
+
+		if res.Sent() {
+			pushAttempts.Add("sent", 1)
+		} else {
+			pushAttempts.Add(res.Reason, 1)
+		}
+
+		if res.Reason == apns2.ReasonExpiredProviderToken {
+			expireToken(client.Token, issuedAt)
+		}
+
+		if !res.Sent() {
+			log.Printf("Failed to send: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+			return res, nil
+		}
+
+		log.Printf("Sent notification to %s -> %v %v %v", notification.DeviceToken, res.StatusCode, res.ApnsID, res.Reason)
+		log.Println("Expiration:", notification.Expiration)
+		log.Println("Priority:", notification.Priority)
+		log.Println("CollapseID:", notification.CollapseID)
+	}
+
+	return res, nil
+}
+
+// tokenIssuedAt returns when a provider token was issued, or 0 for certificate clients.
+func tokenIssuedAt(t *token.Token) int64 {
+	if t == nil {
+		return 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	return t.IssuedAt
+}
+
+// expireToken marks a provider token that APNs reports as expired, which it may do
+// before the client would replace it, for instance after the clock has jumped, so that
+// the client replaces it before the next push. As the token is shared by all pushes
+// for an app, many may fail together, so this is only done if the token is still the
+// one that the failed push was sent with, and old enough to be replaced.
+func expireToken(t *token.Token, issuedAt int64) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.IssuedAt != issuedAt || time.Since(time.Unix(issuedAt, 0)) < minTokenAge {
+		return
+	}
+
+	log.Println("Replacing provider token that APNs reports as expired")
+	t.IssuedAt = 0
+}
+
+// body returns the encrypted body of a push, which has been encoded, and possibly split,
+// to fit in notifications. Bodies are never offloaded for the backends that use this.
+func (m *message) body() ([]byte, error) {
+	var encoded strings.Builder
+	for _, fragment := range m.Fragments {
+		encoded.WriteString(fragment["p"])
+	}
+	encoded.WriteString(m.Fields["p"])
+
+	return decode85(encoded.String())
+}
+
+// wholeFields returns the fields of a message as they would be sent in a notification,
+// but with the whole encoded body in p, for backends that have no need to split it.
+func (m *message) wholeFields() (map[string]string, error) {
+	fields := make(map[string]string, len(m.Fields))
+	for name, value := range m.Fields {
+		fields[name] = value
+	}
+
+	if len(m.Fragments) > 0 {
+		body, err := m.body()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range []string{"m", "i", "n"} {
+			delete(fields, name)
+		}
+		fields["p"] = encode85(body)
+	}
+
+	return fields, nil
+}
+
+// httpStatusReason translates the status code of a failed request to a push service
+// that speaks HTTP into the APNs reason with the same meaning.
+func httpStatusReason(status int) string {
+	switch {
+	case status == 404 || status == 410:
+		return apns2.ReasonUnregistered
+	case status == 413:
+		return apns2.ReasonPayloadTooLarge
+	case status == 429:
+		return apns2.ReasonTooManyRequests
+	case status == 401 || status == 403:
+		return apns2.ReasonForbidden
+	case status == 503:
+		return apns2.ReasonServiceUnavailable
+	case status >= 500:
+		return apns2.ReasonInternalServerError
+	default:
+		return apns2.ReasonBadMessageID
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// deadLetter is a message that could not be delivered, either because it failed with a
+// permanent reason or because its retries ran out. It is kept so that it can be
+// inspected and replayed, for instance after fixing a bad certificate.
+type deadLetter struct {
+	Message    *message  `json:"message"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Reason     string    `json:"reason"`
+	Attempts   int       `json:"attempts"`
+	Failed     time.Time `json:"failed"`
+}
+
+// deadLetterStore keeps dead letters keyed by message ID, up to a limit.
+type deadLetterStore struct {
+	store store
+	limit int
+}
+
+var deadLetters *deadLetterStore
+
+func newDeadLetterStore(dir string, limit int) *deadLetterStore {
+	return &deadLetterStore{
+		store: newStore(dir),
+		limit: limit,
+	}
+}
+
+// Put records a message that could not be delivered. Messages to device tokens that
+// are no longer valid, or that have no device at all, are not recorded, as they can
+// never be delivered.
+func (d *deadLetterStore) Put(m *message, res *apns2.Response, err error, attempts int) {
+	letter := &deadLetter{
+		Message:  m,
+		Attempts: attempts,
+		Failed:   time.Now(),
+	}
+
+	if err != nil {
+		letter.Reason = err.Error()
+	} else {
+		switch res.Reason {
+		case apns2.ReasonUnregistered, apns2.ReasonBadDeviceToken, apns2.ReasonMissingDeviceToken:
+			return
+		}
+
+		letter.StatusCode = res.StatusCode
+		letter.Reason = res.Reason
+	}
+
+	if _, exists := d.store.Get(m.ID); !exists {
+		if keys, err := d.store.Keys(); err == nil && len(keys) >= d.limit {
+			log.Printf("Dead letters full, dropping message %s\n", m.ID)
+			return
+		}
+	}
+
+	value, _ := json.Marshal(letter)
+	if err := d.store.Put(m.ID, value); err != nil {
+		log.Println("Error storing dead letter:", err)
+	}
+}
+
+func (d *deadLetterStore) Get(id string) (*deadLetter, bool) {
+	value, ok := d.store.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	var letter deadLetter
+	if err := json.Unmarshal(value, &letter); err != nil {
+		log.Println("Error reading dead letter:", err)
+		return nil, false
+	}
+
+	return &letter, true
+}
+
+// List returns all dead letters, oldest first.
+func (d *deadLetterStore) List() ([]*deadLetter, error) {
+	keys, err := d.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*deadLetter, 0, len(keys))
+	for _, key := range keys {
+		if letter, ok := d.Get(key); ok {
+			letters = append(letters, letter)
+		}
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].Failed.Before(letters[j].Failed)
+	})
+
+	return letters, nil
+}
+
+func (d *deadLetterStore) Delete(id string) bool {
+	_, existed := d.store.Get(id)
+	if err := d.store.Delete(id); err != nil {
+		log.Println("Error deleting dead letter:", err)
+	}
+	return existed
+}
+
+// replay sends a dead letter again, through the queue if there is one. It is removed
+// first, and is recorded again if it fails again. If the message has expired, APNs
+// attempts to deliver it only once, and does not store it if the device is offline.
+func (d *deadLetterStore) replay(letter *deadLetter) bool {
+	d.Delete(letter.Message.ID)
+	log.Printf("Replaying message %s to %s\n", letter.Message.ID, letter.Message.DeviceToken)
+
+	if queue != nil {
+		if !enqueue(letter.Message) {
+			d.Put(letter.Message, nil, errQueueFull, letter.Attempts)
+			return false
+		}
+		return true
+	}
+
+	res, err := deliverWithRetries(context.Background(), letter.Message)
+	return err == nil && res.Sent()
+}
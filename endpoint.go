@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// endpoint holds the information encoded in a push endpoint URL of the form
+// /relay-to/[<app>/]<environment>/<device-token>[/extra][?k=<key>][&sig=<tag>].
+// If the app is not given in the path, it is selected by the host name the push was
+// sent to.
+type endpoint struct {
+	app         *app
+	environment string
+	deviceToken string
+	extra       string
+
+	// serverKey is the base64url encoded application server key that the subscription
+	// was created for, if any. Pushes to an endpoint with a key must carry a VAPID
+	// authorization signed by that key, as described in RFC 8292 section 4.
+	serverKey string
+
+	// opaque is whether the endpoint hides its device token, by being sealed or by
+	// referring to a registration, and tag is the signature of a raw endpoint, if any.
+	// Raw endpoints must be signed if ENDPOINT_SECRETS is set.
+	opaque bool
+	tag    string
+
+	// registration is the ID of the registration a registered endpoint refers to,
+	// targets are the devices it delivers to, and mailbox is whether pushes to it are
+	// kept in its mailbox.
+	registration string
+	targets      []target
+	mailbox      bool
+}
+
+// parseEndpoint returns the endpoint a push was sent to, which is either a raw endpoint
+// as described above, a sealed one of the form /sealed/<sealed-endpoint> with all the
+// same information encrypted, or a registered one of the form /push/<id>[/extra].
+func parseEndpoint(request *http.Request) (*endpoint, error) {
+	u := request.URL
+
+	if strings.HasPrefix(u.Path, "/sealed/") {
+		e, err := openEndpoint(strings.TrimPrefix(u.Path, "/sealed/"))
+		if err == nil && e.environment == environmentStream {
+			return nil, errStreamNotRegistered
+		}
+		return e, err
+	}
+
+	if strings.HasPrefix(u.Path, "/push/") {
+		return registeredEndpoint(u.Path)
+	}
+
+	if !rawEndpoints {
+		return nil, errors.New("Raw endpoints are disabled: " + u.Path)
+	}
+
+	components := strings.Split(u.Path, "/")
+
+	e := &endpoint{}
+
+	if len(components) > 2 && apps[components[2]] != nil {
+		e.app = apps[components[2]]
+		components = append(components[:2], components[3:]...)
+	} else {
+		e.app = appForHost(request.Host)
+	}
+
+	if len(components) < 4 || components[3] == "" {
+		return nil, errors.New("Invalid URL path: " + u.Path)
+	}
+
+	e.environment = components[2]
+	e.deviceToken = components[3]
+
+	if e.environment == environmentStream {
+		return nil, errStreamNotRegistered
+	}
+
+	if len(components) > 4 {
+		e.extra = strings.Join(components[4:], "/")
+	}
+
+	if err := e.parseServerKey(u); err != nil {
+		return nil, err
+	}
+
+	e.tag = u.Query().Get("sig")
+
+	return e, nil
+}
+
+// parseServerKey sets the application server key of the endpoint from the k query
+// parameter, if there is one.
+func (e *endpoint) parseServerKey(u *url.URL) error {
+	key, err := canonicalServerKey(u.Query().Get("k"))
+	if err != nil {
+		return err
+	}
+
+	e.serverKey = key
+	return nil
+}
+
+// canonicalServerKey returns an application server key in the canonical unpadded
+// base64url form that keys are compared in.
+func canonicalServerKey(key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+
+	bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return "", errors.New("Invalid application server key: " + err.Error())
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// recipients returns the devices that pushes to the endpoint are delivered to.
+func (e *endpoint) recipients() []target {
+	if e.registration != "" {
+		return e.targets
+	}
+	return []target{{Environment: e.environment, DeviceToken: e.deviceToken}}
+}
+
+// contents returns the information in an endpoint in the form that it is sealed or
+// signed in.
+func (e *endpoint) contents() *sealedEndpoint {
+	return &sealedEndpoint{
+		App:         e.app.name,
+		Environment: e.environment,
+		DeviceToken: e.deviceToken,
+		Extra:       e.extra,
+		ServerKey:   e.serverKey,
+	}
+}
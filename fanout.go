@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/sideshow/apns2"
+)
+
+// target is one device that pushes to a registered endpoint are delivered to.
+type target struct {
+	Environment string `json:"environment"`
+	DeviceToken string `json:"token"`
+}
+
+// Device tokens for APNs are hex encoded, and currently 32 bytes long, but Apple may
+// make them longer.
+const (
+	minDeviceTokenLength = 32
+	maxDeviceTokenLength = 100
+)
+
+// valid returns whether a target could be a device, so that pushes to device tokens that
+// cannot exist are rejected without asking APNs, or recording tombstones for them. Only
+// APNs device tokens are checked, as the other backends have their own formats.
+func (t target) valid() bool {
+	if backendNames[t.Environment] {
+		return t.DeviceToken != ""
+	}
+
+	bytes, err := hex.DecodeString(t.DeviceToken)
+	return err == nil && len(bytes) >= minDeviceTokenLength && len(bytes) <= maxDeviceTokenLength
+}
+
+// forTargets returns a copy of a message for each target. The first copy keeps the ID of
+// the message, and the others get their own, as each is delivered, retried and recorded
+// as a dead letter separately.
+func (m *message) forTargets(targets []target) []*message {
+	messages := make([]*message, len(targets))
+	for i, t := range targets {
+		c := *m
+		c.Environment = t.Environment
+		c.DeviceToken = t.DeviceToken
+		if i > 0 {
+			c.ID = newMessageID()
+		}
+		messages[i] = &c
+	}
+	return messages
+}
+
+// fanOut delivers copies of a message to several targets concurrently, and returns the
+// response of a target that accepted it, if any. Otherwise the failure that is most
+// useful to the sender is returned: a network error or transient failure rather than a
+// target being gone, as the push service only considers the endpoint gone if all of
+// its targets are. Retries end with the given context.
+func fanOut(ctx context.Context, messages []*message) (*apns2.Response, error) {
+	type result struct {
+		res *apns2.Response
+		err error
+	}
+
+	results := make([]result, len(messages))
+
+	var wg sync.WaitGroup
+	for i, m := range messages {
+		wg.Add(1)
+		go func(i int, m *message) {
+			defer wg.Done()
+
+			res, err := deliverWithRetries(ctx, m)
+			results[i] = result{res, err}
+
+			outcome := "sent"
+			switch {
+			case err != nil:
+				outcome = "error"
+			case !res.Sent():
+				outcome = res.Reason
+			}
+
+			fanOutResults.Add(outcome, 1)
+			log.Printf("Fan-out of message %s to %s/%s: %s\n", m.ID, m.Environment, m.DeviceToken, outcome)
+		}(i, m)
+	}
+	wg.Wait()
+
+	best := -1
+	for i, r := range results {
+		if r.err == nil && r.res.Sent() {
+			return r.res, nil
+		}
+		if best < 0 || rank(r.res, r.err) > rank(results[best].res, results[best].err) {
+			best = i
+		}
+	}
+
+	return results[best].res, results[best].err
+}
+
+// rank orders the failures of fanned out deliveries by how useful they are to report.
+func rank(res *apns2.Response, err error) int {
+	switch {
+	case err != nil:
+		return 2
+	case webPushStatus(res) == 404 || webPushStatus(res) == 410:
+		return 0
+	default:
+		return 1
+	}
+}
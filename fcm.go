@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sideshow/apns2"
+)
+
+// fcmScope is the OAuth scope needed to send messages through FCM.
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// serviceAccount holds the parts of a Google service account key file that are needed
+// to get access tokens for FCM.
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// fcmBackend sends messages to Android devices through the FCM HTTP v1 API, as data
+// messages with the same fields as APNs notifications, for the app to decrypt.
+type fcmBackend struct {
+	account *serviceAccount
+	baseURL string
+	client  *http.Client
+
+	mutex       sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// loadFCM sets up the FCM backend if a service account key is given in
+// FCM_CREDENTIALS, as a file name, or in FCM_CREDENTIALS_BASE64.
+func loadFCM() {
+	var data []byte
+	if encoded := env("FCM_CREDENTIALS_BASE64", ""); encoded != "" {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			log.Fatal("Base64 decoding error: ", err)
+		}
+	} else if filename := env("FCM_CREDENTIALS", ""); filename != "" {
+		var err error
+		if data, err = ioutil.ReadFile(filename); err != nil {
+			log.Fatal("Error reading FCM credentials: ", err)
+		}
+	} else {
+		return
+	}
+
+	account := &serviceAccount{TokenURI: "https://oauth2.googleapis.com/token"}
+	if err := json.Unmarshal(data, account); err != nil {
+		log.Fatal("Error parsing FCM credentials: ", err)
+	}
+
+	account.ProjectID = env("FCM_PROJECT_ID", account.ProjectID)
+	if account.ProjectID == "" || account.ClientEmail == "" {
+		log.Fatal("FCM credentials must include project_id and client_email")
+	}
+
+	if _, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey)); err != nil {
+		log.Fatal("Error parsing FCM private key: ", err)
+	}
+
+	backends[environmentFCM] = &fcmBackend{
+		account: account,
+		baseURL: strings.TrimRight(env("FCM_BASE_URL", "https://fcm.googleapis.com"), "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+
+	log.Println("Sending to FCM for project", account.ProjectID)
+}
+
+// token returns an OAuth access token for the service account, getting a new one when
+// the current one is about to expire.
+func (f *fcmBackend) token() (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.accessToken != "" && time.Now().Before(f.expires.Add(-time.Minute)) {
+		return f.accessToken, nil
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(f.account.PrivateKey))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	assertion.Header["kid"] = f.account.PrivateKeyID
+
+	signed, err := assertion.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := f.client.PostForm(f.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || res.StatusCode != 200 || body.AccessToken == "" {
+		return "", errors.New(fmt.Sprintf("Error getting FCM access token: status %d", res.StatusCode))
+	}
+
+	f.accessToken = body.AccessToken
+	f.expires = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+
+	return f.accessToken, nil
+}
+
+// fcmMessage is the body of a request to send a message through FCM.
+type fcmMessage struct {
+	Message struct {
+		Token   string            `json:"token"`
+		Data    map[string]string `json:"data"`
+		Android struct {
+			Priority    string `json:"priority"`
+			TTL         string `json:"ttl,omitempty"`
+			CollapseKey string `json:"collapse_key,omitempty"`
+		} `json:"android"`
+	} `json:"message"`
+}
+
+// fcmErrorReasons translates the error codes of FCM into the APNs reasons with the same
+// meaning. A sender ID mismatch means the service is configured with the wrong project,
+// and so, like a wrong APNs topic, does not make the subscription go away.
+var fcmErrorReasons = map[string]string{
+	"UNREGISTERED":           apns2.ReasonUnregistered,
+	"SENDER_ID_MISMATCH":     apns2.ReasonDeviceTokenNotForTopic,
+	"QUOTA_EXCEEDED":         apns2.ReasonTooManyRequests,
+	"UNAVAILABLE":            apns2.ReasonServiceUnavailable,
+	"INTERNAL":               apns2.ReasonInternalServerError,
+	"THIRD_PARTY_AUTH_ERROR": apns2.ReasonForbidden,
+	"INVALID_ARGUMENT":       apns2.ReasonBadMessageID,
+}
+
+// push sends a message through FCM, with each of its fragments, if it was split, as a
+// message of its own, in the same way as for APNs.
+func (f *fcmBackend) push(m *message) (*apns2.Response, error) {
+	all := make([]map[string]string, 0, len(m.Fragments)+1)
+	all = append(append(all, m.Fragments...), m.Fields)
+
+	var res *apns2.Response
+	for i, fields := range all {
+		var err error
+		res, err = f.send(m, fields, i < len(m.Fragments))
+		if err != nil {
+			pushAttempts.Add("error", 1)
+			log.Println("FCM push error:", err)
+			return nil, err
+		}
+
+		if !res.Sent() {
+			pushAttempts.Add(res.Reason, 1)
+			log.Printf("Failed to send through FCM: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+			return res, nil
+		}
+
+		pushAttempts.Add("sent", 1)
+		log.Printf("Sent FCM message to %s -> %v %v\n", m.DeviceToken, res.StatusCode, res.ApnsID)
+	}
+
+	return res, nil
+}
+
+func (f *fcmBackend) send(m *message, fields map[string]string, fragment bool) (*apns2.Response, error) {
+	var body fcmMessage
+	body.Message.Token = m.DeviceToken
+	body.Message.Data = fields
+
+	body.Message.Android.Priority = "high"
+	if fragment || m.Silent || m.Priority == apns2.PriorityLow {
+		body.Message.Android.Priority = "normal"
+	}
+
+	if !fragment && !m.Silent {
+		body.Message.Android.CollapseKey = m.CollapseID
+	}
+
+	if !m.Expiration.IsZero() {
+		ttl := time.Until(m.Expiration) / time.Second
+		if ttl < 0 {
+			ttl = 0
+		}
+		body.Message.Android.TTL = fmt.Sprintf("%ds", ttl)
+	}
+
+	token, err := f.token()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, _ := json.Marshal(&body)
+	request, _ := http.NewRequest("POST", f.baseURL+"/v1/projects/"+url.PathEscape(f.account.ProjectID)+"/messages:send", bytes.NewReader(encoded))
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := f.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	res := &apns2.Response{StatusCode: response.StatusCode, ApnsID: m.ID}
+	if response.StatusCode == 200 {
+		return res, nil
+	}
+
+	var failure struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(response.Body).Decode(&failure)
+
+	code := failure.Error.Status
+	for _, detail := range failure.Error.Details {
+		if detail.ErrorCode != "" {
+			code = detail.ErrorCode
+		}
+	}
+
+	res.Reason = fcmErrorReasons[code]
+	res.Timestamp.Time = time.Now()
+
+	switch {
+	case response.StatusCode == 401:
+		// The access token was rejected, so get a new one for the next attempt.
+		f.mutex.Lock()
+		f.accessToken = ""
+		f.mutex.Unlock()
+		res.Reason = apns2.ReasonInvalidProviderToken
+	case code == "INVALID_ARGUMENT" && strings.Contains(failure.Error.Message, "registration token"):
+		res.Reason = apns2.ReasonBadDeviceToken
+	case code == "INVALID_ARGUMENT" && strings.Contains(failure.Error.Message, "too big"):
+		res.Reason = apns2.ReasonPayloadTooLarge
+	}
+
+	return res, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// fakeFCM is a local stand-in for the Google token endpoint and the FCM API, which
+// answers sends with the given status and body, and records what it was sent.
+type fakeFCM struct {
+	server *httptest.Server
+
+	status   int
+	response string
+
+	tokens        int
+	authorization string
+	sent          fcmMessage
+}
+
+func newFakeFCM(t *testing.T) (*fakeFCM, *fcmBackend) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	fake := &fakeFCM{status: 200, response: `{"name": "projects/test/messages/1"}`}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
+		if request.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || request.FormValue("assertion") == "" {
+			writer.WriteHeader(400)
+			return
+		}
+
+		fake.tokens++
+		fmt.Fprintf(writer, `{"access_token": "token-%d", "expires_in": 3600}`, fake.tokens)
+	})
+	mux.HandleFunc("/v1/projects/test/messages:send", func(writer http.ResponseWriter, request *http.Request) {
+		fake.authorization = request.Header.Get("Authorization")
+		fake.sent = fcmMessage{}
+		json.NewDecoder(request.Body).Decode(&fake.sent)
+
+		writer.WriteHeader(fake.status)
+		fmt.Fprint(writer, fake.response)
+	})
+
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+
+	f := &fcmBackend{
+		account: &serviceAccount{
+			ProjectID:   "test",
+			PrivateKey:  string(privateKey),
+			ClientEmail: "relay@test.iam.gserviceaccount.com",
+			TokenURI:    fake.server.URL + "/token",
+		},
+		baseURL: fake.server.URL,
+		client:  fake.server.Client(),
+	}
+
+	return fake, f
+}
+
+func TestFCMSend(t *testing.T) {
+	fake, f := newFakeFCM(t)
+
+	m := &message{
+		ID:          newMessageID(),
+		Environment: environmentFCM,
+		DeviceToken: "android-token",
+		Fields:      map[string]string{"p": "body", "k": "key", "s": "salt", "x": "extra"},
+		Priority:    apns2.PriorityHigh,
+		CollapseID:  "topic",
+		Expiration:  time.Now().Add(time.Hour),
+	}
+
+	res, err := f.push(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Sent() {
+		t.Fatalf("push not sent: %d %s", res.StatusCode, res.Reason)
+	}
+
+	if fake.authorization != "Bearer token-1" {
+		t.Errorf("Authorization = %q, want the access token", fake.authorization)
+	}
+
+	sent := fake.sent.Message
+	if sent.Token != "android-token" {
+		t.Errorf("token = %q, want android-token", sent.Token)
+	}
+	for name, value := range m.Fields {
+		if sent.Data[name] != value {
+			t.Errorf("data[%s] = %q, want %q", name, sent.Data[name], value)
+		}
+	}
+	if len(sent.Data) != len(m.Fields) {
+		t.Errorf("data = %v, want %v", sent.Data, m.Fields)
+	}
+	if sent.Android.Priority != "high" {
+		t.Errorf("priority = %q, want high", sent.Android.Priority)
+	}
+	if sent.Android.TTL != "3599s" && sent.Android.TTL != "3600s" {
+		t.Errorf("ttl = %q, want 3600s", sent.Android.TTL)
+	}
+	if sent.Android.CollapseKey != "topic" {
+		t.Errorf("collapse_key = %q, want topic", sent.Android.CollapseKey)
+	}
+
+	// The access token is reused for later messages.
+	m.Priority = apns2.PriorityLow
+	m.Expiration = time.Time{}
+	if _, err := f.push(m); err != nil {
+		t.Fatal(err)
+	}
+	if fake.tokens != 1 {
+		t.Errorf("got %d access tokens, want 1", fake.tokens)
+	}
+
+	sent = fake.sent.Message
+	if sent.Android.Priority != "normal" {
+		t.Errorf("low priority = %q, want normal", sent.Android.Priority)
+	}
+	if sent.Android.TTL != "" {
+		t.Errorf("ttl without expiration = %q, want none", sent.Android.TTL)
+	}
+}
+
+func TestFCMUnregistered(t *testing.T) {
+	fake, f := newFakeFCM(t)
+	fake.status = 404
+	fake.response = `{"error": {"code": 404, "status": "NOT_FOUND", "message": "Requested entity was not found.",
+		"details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`
+
+	backends[environmentFCM] = f
+	defer delete(backends, environmentFCM)
+	defaultApp = &app{name: "default"}
+	tombstones = newTombstoneStore("", time.Hour, 10)
+
+	m := &message{ID: newMessageID(), Environment: environmentFCM, DeviceToken: "gone-token", Fields: map[string]string{"p": "body"}}
+
+	res, err := deliver(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != apns2.ReasonUnregistered {
+		t.Errorf("reason = %q, want %s", res.Reason, apns2.ReasonUnregistered)
+	}
+	if status := webPushStatus(res); status != 410 {
+		t.Errorf("status = %d, want 410", status)
+	}
+	if _, ok := tombstones.Get(tombstoneKey(defaultApp, environmentFCM, "gone-token")); !ok {
+		t.Error("no tombstone for the unregistered token")
+	}
+}
+
+func TestFCMAccessTokenRejected(t *testing.T) {
+	fake, f := newFakeFCM(t)
+	fake.status = 401
+	fake.response = `{"error": {"code": 401, "status": "UNAUTHENTICATED"}}`
+
+	m := &message{ID: newMessageID(), Environment: environmentFCM, DeviceToken: "android-token", Fields: map[string]string{"p": "body"}}
+
+	res, err := f.push(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != apns2.ReasonInvalidProviderToken {
+		t.Errorf("reason = %q, want %s", res.Reason, apns2.ReasonInvalidProviderToken)
+	}
+	if f.accessToken != "" {
+		t.Error("rejected access token was kept")
+	}
+
+	fake.status = 200
+	if res, err := f.push(m); err != nil || !res.Sent() {
+		t.Fatalf("push after new token failed: %v %v", res, err)
+	}
+	if fake.tokens != 2 || fake.authorization != "Bearer token-2" {
+		t.Errorf("got %d access tokens, sent with %q, want a new one", fake.tokens, fake.authorization)
+	}
+}
@@ -1,7 +1,7 @@
 module github.com/DagAgren/toot-relay
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/sideshow/apns2 v0.0.0-20181014012405-060d44b53d05
 	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e // indirect
 	golang.org/x/net v0.0.0-20181017193950-04a2e542c03f // indirect
@@ -2,9 +2,17 @@ import UserNotifications
 
 extension UNNotificationContent {
 	public func decrypt(state: PushNotificationState) throws -> PushNotification {
-		// TODO: aes128gcm only uses p and x.
-		guard let payload = (userInfo["p"] as? String)?.decode85(),
-		let salt = (userInfo["s"] as? String)?.decode85(),
+		guard let payload = (userInfo["p"] as? String)?.decode85() else {
+			throw DecryptNotificationErrorType.fieldsNotFound
+		}
+
+		if userInfo["e"] as? String == "aes128gcm" {
+			let decrypted = try state.receiver.decrypt(aes128gcmPayload: payload)
+
+			return try JSONDecoder().decode(PushNotification.self, from: decrypted)
+		}
+
+		guard let salt = (userInfo["s"] as? String)?.decode85(),
 		let serverPublicKeyData = (userInfo["k"] as? String)?.decode85() else {
 			throw DecryptNotificationErrorType.fieldsNotFound
 		}
@@ -47,29 +47,8 @@ extension PushNotificationReceiver {
 
 extension PushNotificationReceiver {
 	func decrypt(payload: Data, salt: Data, serverPublicKeyData: Data) throws -> Data {
-		var error: Unmanaged<CFError>?
-
-		guard let privateKey = SecKeyCreateWithData(privateKeyData as CFData,[
-			kSecAttrKeyType as String: kSecAttrKeyTypeECSECPrimeRandom,
-			kSecAttrKeyClass as String: kSecAttrKeyClassPrivate,
-			kSecAttrKeySizeInBits as String: 256,
-		] as CFDictionary, &error) else {
-			throw PushNotificationReceiverErrorType.restoringKeyFailed(error?.takeRetainedValue())
-		}
+		let sharedSecret = try self.sharedSecret(serverPublicKeyData: serverPublicKeyData)
 
-		guard let serverPublicKey = SecKeyCreateWithData(serverPublicKeyData as CFData,[
-			kSecAttrKeyType as String: kSecAttrKeyTypeECSECPrimeRandom,
-			kSecAttrKeyClass as String: kSecAttrKeyClassPublic,
-			kSecAttrKeySizeInBits as String: 256,
-		] as CFDictionary, &error) else {
-			throw PushNotificationReceiverErrorType.creatingKeyFailed(error?.takeRetainedValue())
-		}
-
-		guard let sharedSecret = SecKeyCopyKeyExchangeResult(privateKey, .ecdhKeyExchangeStandard, serverPublicKey, [:] as CFDictionary, &error) as Data? else {
-			throw PushNotificationReceiverErrorType.keyExhangedFailed(error?.takeRetainedValue())
-		}
-
-		// TODO: These steps are slightly different from aes128gcm
 		let secondSaltInfo = "Content-Encoding: auth\0".data(using: .utf8)!
 		let secondSalt = deriveKey(firstSalt: authentication, secondSalt: sharedSecret, info: secondSaltInfo, length: 32)
 
@@ -96,6 +75,73 @@ extension PushNotificationReceiver {
 		return unpadded
 	}
 
+	// Decrypts an aes128gcm body as described in RFC 8291. The body starts with the
+	// RFC 8188 record header, which holds the salt, record size and server public key.
+	func decrypt(aes128gcmPayload body: Data) throws -> Data {
+		let body = Data(body)
+		guard body.count >= 21 else {
+			throw PushNotificationReceiverErrorType.invalidRecordHeader
+		}
+
+		let salt = body.subdata(in: 0 ..< 16)
+		let keyIDLength = Int(body[20])
+		guard keyIDLength == 65, body.count >= 21 + keyIDLength else {
+			throw PushNotificationReceiverErrorType.invalidRecordHeader
+		}
+
+		let serverPublicKeyData = body.subdata(in: 21 ..< 21 + keyIDLength)
+		let payload = body.subdata(in: 21 + keyIDLength ..< body.count)
+
+		let sharedSecret = try self.sharedSecret(serverPublicKeyData: serverPublicKeyData)
+
+		var keyInfo = "WebPush: info\0".data(using: .utf8)!
+		keyInfo.append(publicKeyData)
+		keyInfo.append(serverPublicKeyData)
+		let inputKey = deriveKey(firstSalt: authentication, secondSalt: sharedSecret, info: keyInfo, length: 32)
+
+		let contentKeyInfo = "Content-Encoding: aes128gcm\0".data(using: .utf8)!
+		let key = deriveKey(firstSalt: salt, secondSalt: inputKey, info: contentKeyInfo, length: 16)
+
+		let nonceInfo = "Content-Encoding: nonce\0".data(using: .utf8)!
+		let nonce = deriveKey(firstSalt: salt, secondSalt: inputKey, info: nonceInfo, length: 12)
+
+		let gcm = try SwiftGCM(key: key, nonce: nonce, tagSize: 16)
+		let clearText = try gcm.decrypt(auth: nil, ciphertext: payload)
+
+		// Padding is a delimiter byte, which is 2 for the last record, followed by zeroes.
+		guard let delimiterIndex = clearText.lastIndex(where: { $0 != 0 }), clearText[delimiterIndex] == 2 else {
+			throw PushNotificationReceiverErrorType.invalidPadding
+		}
+
+		return clearText.prefix(upTo: delimiterIndex)
+	}
+
+	private func sharedSecret(serverPublicKeyData: Data) throws -> Data {
+		var error: Unmanaged<CFError>?
+
+		guard let privateKey = SecKeyCreateWithData(privateKeyData as CFData,[
+			kSecAttrKeyType as String: kSecAttrKeyTypeECSECPrimeRandom,
+			kSecAttrKeyClass as String: kSecAttrKeyClassPrivate,
+			kSecAttrKeySizeInBits as String: 256,
+		] as CFDictionary, &error) else {
+			throw PushNotificationReceiverErrorType.restoringKeyFailed(error?.takeRetainedValue())
+		}
+
+		guard let serverPublicKey = SecKeyCreateWithData(serverPublicKeyData as CFData,[
+			kSecAttrKeyType as String: kSecAttrKeyTypeECSECPrimeRandom,
+			kSecAttrKeyClass as String: kSecAttrKeyClassPublic,
+			kSecAttrKeySizeInBits as String: 256,
+		] as CFDictionary, &error) else {
+			throw PushNotificationReceiverErrorType.creatingKeyFailed(error?.takeRetainedValue())
+		}
+
+		guard let sharedSecret = SecKeyCopyKeyExchangeResult(privateKey, .ecdhKeyExchangeStandard, serverPublicKey, [:] as CFDictionary, &error) as Data? else {
+			throw PushNotificationReceiverErrorType.keyExhangedFailed(error?.takeRetainedValue())
+		}
+
+		return sharedSecret
+	}
+
 	private func deriveKey(firstSalt: Data, secondSalt: Data, info: Data, length: Int) -> Data {
 		return firstSalt.withUnsafeBytes { (firstSaltBytes: UnsafePointer<UInt8>) -> Data in
 			return secondSalt.withUnsafeBytes { (secondSaltBytes: UnsafePointer<UInt8>) -> Data in
@@ -151,4 +197,6 @@ enum PushNotificationReceiverErrorType: Error {
 	case creatingRandomDataFailed(Error?)
 	case keyExhangedFailed(Error?)
 	case clearTextTooShort
+	case invalidRecordHeader
+	case invalidPadding
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMailboxPage is the most messages returned by a single request to a mailbox.
+const maxMailboxPage = 100
+
+// mailboxEntry is a push kept in a mailbox, with the same fields, still encrypted, as the
+// notification it was sent as, before any offloading or splitting.
+type mailboxEntry struct {
+	Cursor   int64             `json:"cursor"`
+	ID       string            `json:"id"`
+	Fields   map[string]string `json:"fields"`
+	Received time.Time         `json:"received"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// mailbox holds the most recent pushes to a registration, oldest first, and the cursor
+// that the next one will get.
+type mailbox struct {
+	Next    int64          `json:"next"`
+	Entries []mailboxEntry `json:"entries"`
+}
+
+// mailboxStore keeps the mailboxes of registrations that have opted in, so that the app
+// can fetch the pushes it missed while the device was offline, as APNs only keeps the
+// last one. Pushes are kept until they expire or are acknowledged, and only the most
+// recent ones are kept if there are more than the size of a mailbox.
+type mailboxStore struct {
+	store store
+	size  int
+
+	// ttl is the longest time to keep pushes, which applies to pushes without a TTL.
+	ttl time.Duration
+
+	// mutex serializes changes to mailboxes, which are read, modified and written back.
+	mutex sync.Mutex
+}
+
+// mailboxes is nil unless mailboxes are enabled by MAILBOX_SIZE.
+var mailboxes *mailboxStore
+
+func newMailboxStore(dir string, size int, ttl time.Duration) *mailboxStore {
+	b := &mailboxStore{
+		store: newStore(dir),
+		size:  size,
+		ttl:   ttl,
+	}
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			b.expire()
+		}
+	}()
+
+	return b
+}
+
+// get returns the mailbox of a registration without the entries that have expired, and
+// whether there were any.
+func (b *mailboxStore) get(id string) (*mailbox, bool) {
+	box := &mailbox{Next: 1}
+
+	value, ok := b.store.Get(id)
+	if !ok {
+		return box, false
+	}
+
+	if err := json.Unmarshal(value, box); err != nil {
+		log.Println("Error reading mailbox:", err)
+	}
+
+	// Drop the entries that have expired.
+	now := time.Now()
+	entries := box.Entries[:0]
+	for _, entry := range box.Entries {
+		if entry.Expires.After(now) {
+			entries = append(entries, entry)
+		}
+	}
+	expired := len(entries) < len(box.Entries)
+	box.Entries = entries
+
+	return box, expired
+}
+
+func (b *mailboxStore) put(id string, box *mailbox) error {
+	value, _ := json.Marshal(box)
+	return b.store.Put(id, value)
+}
+
+// Put adds a push to the mailbox of a registration, dropping the oldest ones if it is
+// full. It returns the entry it was kept as, and false if it had already expired.
+func (b *mailboxStore) Put(id string, m *message) (mailboxEntry, bool) {
+	expires := m.Received.Add(b.ttl)
+	if !m.Expiration.IsZero() && m.Expiration.Before(expires) {
+		expires = m.Expiration
+	}
+
+	if !expires.After(time.Now()) {
+		return mailboxEntry{}, false
+	}
+
+	fields := make(map[string]string, len(m.Fields))
+	for name, value := range m.Fields {
+		fields[name] = value
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	box, _ := b.get(id)
+	entry := mailboxEntry{
+		Cursor:   box.Next,
+		ID:       m.ID,
+		Fields:   fields,
+		Received: m.Received,
+		Expires:  expires,
+	}
+	box.Entries = append(box.Entries, entry)
+	box.Next++
+
+	if len(box.Entries) > b.size {
+		box.Entries = box.Entries[len(box.Entries)-b.size:]
+	}
+
+	if err := b.put(id, box); err != nil {
+		log.Println("Error storing message in mailbox:", err)
+	}
+
+	return entry, true
+}
+
+// Since returns up to limit entries after the given cursor, and whether there are more.
+func (b *mailboxStore) Since(id string, cursor int64, limit int) ([]mailboxEntry, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries := []mailboxEntry{}
+	box, _ := b.get(id)
+	for _, entry := range box.Entries {
+		if entry.Cursor <= cursor {
+			continue
+		}
+		if len(entries) == limit {
+			return entries, true
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, false
+}
+
+// Ack removes the entries up to and including the given cursor.
+func (b *mailboxStore) Ack(id string, cursor int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	box, _ := b.get(id)
+	entries := box.Entries[:0]
+	for _, entry := range box.Entries {
+		if entry.Cursor > cursor {
+			entries = append(entries, entry)
+		}
+	}
+	box.Entries = entries
+
+	return b.put(id, box)
+}
+
+func (b *mailboxStore) Delete(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.store.Delete(id)
+}
+
+// expire drops expired entries from all mailboxes. Empty mailboxes are kept, so that
+// their cursors do not start over.
+func (b *mailboxStore) expire() {
+	keys, err := b.store.Keys()
+	if err != nil {
+		log.Println("Error listing mailboxes:", err)
+		return
+	}
+
+	for _, key := range keys {
+		b.mutex.Lock()
+		if box, expired := b.get(key); expired {
+			if err := b.put(key, box); err != nil {
+				log.Println("Error expiring mailbox:", err)
+			}
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// mailboxHandler serves the mailboxes of registrations:
+//
+//	GET  /mailbox/<id>[?since=<cursor>][&limit=<n>] lists the pushes after a cursor
+//	POST /mailbox/<id>/ack                          acknowledges them up to a cursor
+//
+// Both must be authorized with the secret of the registration, as a bearer token.
+func mailboxHandler(writer http.ResponseWriter, request *http.Request) {
+	components := strings.Split(strings.TrimPrefix(request.URL.Path, "/mailbox/"), "/")
+	id := components[0]
+
+	reg, ok := registry.Get(id)
+	if !ok {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Unknown subscription:", id)
+		return
+	}
+
+	if !authorizeRegistration(writer, request, reg) {
+		return
+	}
+
+	switch {
+	case len(components) == 1 && request.Method == "GET":
+		var cursor int64
+		if since := request.URL.Query().Get("since"); since != "" {
+			var err error
+			if cursor, err = strconv.ParseInt(since, 10, 64); err != nil {
+				writer.WriteHeader(400)
+				fmt.Fprintln(writer, "Invalid cursor:", since)
+				return
+			}
+		}
+
+		limit := maxMailboxPage
+		if value := request.URL.Query().Get("limit"); value != "" {
+			if n, err := strconv.Atoi(value); err == nil && n > 0 && n < limit {
+				limit = n
+			}
+		}
+
+		entries, more := mailboxes.Since(id, cursor, limit)
+		if len(entries) > 0 {
+			cursor = entries[len(entries)-1].Cursor
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"messages": entries,
+			"cursor":   cursor,
+			"more":     more,
+		})
+	case len(components) == 2 && components[1] == "ack" && request.Method == "POST":
+		var ack struct {
+			Cursor int64 `json:"cursor"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&ack); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Invalid acknowledgement:", err)
+			return
+		}
+
+		if err := mailboxes.Ack(id, ack.Cursor); err != nil {
+			writer.WriteHeader(500)
+			fmt.Fprintln(writer, "Error updating mailbox:", err)
+			log.Println("Error updating mailbox:", err)
+			return
+		}
+
+		writer.WriteHeader(204)
+	default:
+		writer.WriteHeader(405)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// message is a push that has been accepted for delivery to a device. It holds only
+// plain data, so that it can be queued and stored.
+type message struct {
+	ID          string `json:"id"`
+	App         string `json:"app"`
+	Environment string `json:"environment"`
+	DeviceToken string `json:"device_token"`
+
+	// Registration is the ID of the registration the message was pushed to, if any, so
+	// that the device token can be removed from it if it turns out to be gone.
+	Registration string `json:"registration,omitempty"`
+
+	// Fields are the custom fields of the notification payload: the encoded body in p,
+	// the key and salt in k and s, the extra value in x, and the encoding in e.
+	Fields map[string]string `json:"fields"`
+
+	// Silent is whether the message is sent as a silent, low priority notification, as
+	// for messages in a storm.
+	Silent bool `json:"silent,omitempty"`
+
+	// Fragments are the fields of silent notifications sent before the main one, if the
+	// message was too large for a single notification and was split.
+	Fragments []map[string]string `json:"fragments,omitempty"`
+
+	// Headers are the headers of the original push request, except for its
+	// authorization, for inspecting messages that could not be delivered.
+	Headers http.Header `json:"headers,omitempty"`
+
+	Expiration time.Time `json:"expiration,omitempty"`
+	Priority   int       `json:"priority"`
+	CollapseID string    `json:"collapse_id,omitempty"`
+	Received   time.Time `json:"received"`
+}
+
+// newMessageID returns a random UUID, which is used as the APNs ID of the message.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// app returns the app profile the message is for. Messages for apps that are no longer
+// configured, such as stored ones from before a configuration change, go to the default
+// app.
+func (m *message) app() *app {
+	if a, ok := apps[m.App]; ok {
+		return a
+	}
+	return defaultApp
+}
+
+func (m *message) notification() *apns2.Notification {
+	a := m.app()
+
+	// Silent notifications are sent like fragments, without a collapse ID, so that they
+	// do not replace an alert that is shown.
+	if m.Silent {
+		n := m.fragmentNotification(m.Fields)
+		n.ApnsID = m.ID
+		return n
+	}
+
+	p := payload.NewPayload().Alert(a.alert).MutableContent().ContentAvailable()
+
+	if a.sound != "" {
+		p.Sound(a.sound)
+	}
+
+	addFields(p, m.Fields)
+
+	return &apns2.Notification{
+		ApnsID:      m.ID,
+		DeviceToken: m.DeviceToken,
+		Topic:       a.topic,
+		Expiration:  m.Expiration,
+		Priority:    m.Priority,
+		CollapseID:  m.CollapseID,
+		Payload:     p,
+	}
+}
+
+// fragmentNotification returns a silent notification for one of the fragments that a
+// message was split into. It has no collapse ID, as the client needs every fragment.
+func (m *message) fragmentNotification(fields map[string]string) *apns2.Notification {
+	p := payload.NewPayload().ContentAvailable()
+
+	addFields(p, fields)
+
+	return &apns2.Notification{
+		DeviceToken: m.DeviceToken,
+		Topic:       m.app().topic,
+		Expiration:  m.Expiration,
+		Priority:    apns2.PriorityLow,
+		Payload:     p,
+	}
+}
+
+// notifications returns all notifications that a message is sent as, in order.
+func (m *message) notifications() []*apns2.Notification {
+	notifications := make([]*apns2.Notification, 0, len(m.Fragments)+1)
+	for _, fields := range m.Fragments {
+		notifications = append(notifications, m.fragmentNotification(fields))
+	}
+	return append(notifications, m.notification())
+}
+
+func addFields(p *payload.Payload, fields map[string]string) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p.Custom(name, fields[name])
+	}
+}
+
+// deliver sends a message through the backend for its environment, and records device
+// tokens that turn out to be no longer valid.
+func deliver(m *message) (*apns2.Response, error) {
+	b, ok := backendFor(m.Environment)
+	if !ok {
+		return nil, errors.New("No backend configured for " + m.Environment)
+	}
+
+	res, err := b.push(m)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.Reason {
+	case apns2.ReasonUnregistered, apns2.ReasonBadDeviceToken:
+		tombstones.Put(tombstoneKey(m.app(), m.Environment, m.DeviceToken), res.Reason, res.Timestamp.Time)
+		if m.Registration != "" && registry != nil {
+			registry.prune(m.Registration, m.DeviceToken)
+		}
+	}
+
+	return res, nil
+}
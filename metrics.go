@@ -0,0 +1,40 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Metrics are published by expvar, and served as JSON at /admin/metrics.
+var (
+	// pushAttempts counts every attempt at sending a notification, by its outcome: "sent",
+	// "error" for network errors, or the reason APNs gave for rejecting it.
+	pushAttempts = expvar.NewMap("push_attempts")
+
+	// pushRetries counts the attempts that were retries of an earlier failed attempt.
+	pushRetries = expvar.NewInt("push_retries")
+
+	// fanOutResults counts the outcomes of delivering pushes to the targets of endpoints
+	// with several of them, as for pushAttempts, and "pruned" for targets removed after
+	// turning out to be gone.
+	fanOutResults = expvar.NewMap("fan_out_results")
+
+	// rateLimited counts the pushes rejected by rate limits, by what was limited: "ip",
+	// "vapid" or "token". denied counts those rejected by the deny-lists, in the same way.
+	rateLimited = expvar.NewMap("rate_limited")
+	denied      = expvar.NewMap("denied")
+
+	// stormMessages counts the messages affected by storm protection: "held" back to be
+	// coalesced, "coalesced" into later ones, and sent "silent".
+	stormMessages = expvar.NewMap("storm_messages")
+)
+
+// metricsHandler serves GET /admin/metrics, which shows the metrics along with Go's
+// runtime statistics.
+func metricsHandler(writer http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(writer, request) {
+		return
+	}
+
+	expvar.Handler().ServeHTTP(writer, request)
+}
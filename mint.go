@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// mintToken is the bearer token required to mint endpoints with POST /endpoints, which
+// is disabled if it is not set. Without it, anyone could get an endpoint for any device
+// token, which is what sealing and signing endpoints are meant to prevent.
+var mintToken string
+
+// mintRequest is the body of a request to mint an endpoint.
+type mintRequest struct {
+	App         string `json:"app"`
+	Environment string `json:"environment"`
+	DeviceToken string `json:"token"`
+	Extra       string `json:"extra"`
+	ServerKey   string `json:"key"`
+
+	// Format is either "sealed" or "signed". It defaults to sealed endpoints if
+	// ENDPOINT_KEYS is set, and signed ones otherwise.
+	Format string `json:"format"`
+}
+
+// mint returns the path of a new endpoint, including its query if any.
+func (r *mintRequest) mint() (string, error) {
+	if r.Environment == "" || r.DeviceToken == "" {
+		return "", errors.New("Environment and token are required")
+	}
+
+	if r.Environment == environmentStream {
+		return "", errStreamNotRegistered
+	}
+
+	if !(target{Environment: r.Environment, DeviceToken: r.DeviceToken}).valid() {
+		return "", errors.New("Invalid device token: " + r.DeviceToken)
+	}
+
+	contents := &sealedEndpoint{
+		App:         r.App,
+		Environment: r.Environment,
+		DeviceToken: r.DeviceToken,
+		Extra:       r.Extra,
+	}
+
+	if r.ServerKey != "" {
+		bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.ServerKey, "="))
+		if err != nil {
+			return "", errors.New("Invalid application server key: " + err.Error())
+		}
+		contents.ServerKey = base64.RawURLEncoding.EncodeToString(bytes)
+	}
+
+	format := r.Format
+	if format == "" {
+		format = "signed"
+		if len(sealingKeys) > 0 {
+			format = "sealed"
+		}
+	}
+
+	switch format {
+	case "sealed":
+		sealed, err := sealEndpoint(contents)
+		if err != nil {
+			return "", err
+		}
+		return "/sealed/" + sealed, nil
+	case "signed":
+		return signedEndpoint(contents)
+	default:
+		return "", errors.New("Unknown format: " + format)
+	}
+}
+
+// mintHandler serves POST /endpoints, which returns a sealed or signed endpoint for the
+// app, environment, device token, extra value and application server key in the JSON
+// body.
+func mintHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writer.Header().Set("Allow", "POST")
+		writer.WriteHeader(405)
+		return
+	}
+
+	authorization := request.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+mintToken)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(401)
+		fmt.Fprintln(writer, "Unauthorized")
+		log.Println("Unauthorized request to mint an endpoint")
+		return
+	}
+
+	var r mintRequest
+	if err := json.NewDecoder(request.Body).Decode(&r); err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Invalid request:", err)
+		return
+	}
+
+	if r.App != "" && apps[r.App] == nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Unknown app:", r.App)
+		return
+	}
+
+	path, err := r.mint()
+	if err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(201)
+	json.NewEncoder(writer).Encode(map[string]string{"endpoint": origin(request) + path})
+}
+
+// mintCommand implements "toot-relay mint", which prints a sealed or signed endpoint.
+func mintCommand(args []string) {
+	var r mintRequest
+
+	flags := flag.NewFlagSet("mint", flag.ExitOnError)
+	flags.StringVar(&r.App, "app", "", "app profile to push to, if not the default app")
+	flags.StringVar(&r.Environment, "environment", "production", "APNs environment, production or development")
+	flags.StringVar(&r.DeviceToken, "token", "", "hex encoded device token")
+	flags.StringVar(&r.Extra, "extra", "", "extra value relayed to the client")
+	flags.StringVar(&r.ServerKey, "key", "", "base64url encoded application server key to bind the endpoint to")
+	flags.StringVar(&r.Format, "format", "", "sealed or signed, defaulting to sealed if ENDPOINT_KEYS is set")
+	flags.Parse(args)
+
+	path, err := r.mint()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	base := env("PUBLIC_URL", "")
+	fmt.Println(strings.TrimRight(base, "/") + path)
+}
+
+func loadSealingConfiguration() {
+	var err error
+	sealingKeys, err = loadSealingKeys(env("ENDPOINT_KEYS", ""))
+	if err != nil {
+		log.Fatal("Invalid ENDPOINT_KEYS: ", err)
+	}
+
+	endpointSecrets = loadEndpointSecrets(env("ENDPOINT_SECRETS", ""))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPayloadSize is the largest notification payload APNs accepts.
+const maxPayloadSize = 4096
+
+// maxBodySize is the largest push body accepted, as set by MAX_BODY_SIZE. Push services
+// need only accept 4096 bytes (RFC 8030 section 7.2), which an RFC 8291 message fits in
+// along with its header.
+var maxBodySize int64 = 4096
+
+// offloadGrace is how long an offloaded body is kept after the message expires, to give
+// the notification service extension time to fetch it after the notification arrives.
+const offloadGrace = 10 * time.Minute
+
+// blob is an encrypted body that was too large to send through APNs, and is fetched
+// by the client instead.
+type blob struct {
+	Data    []byte    `json:"data"`
+	Expires time.Time `json:"expires"`
+}
+
+// blobStore keeps offloaded bodies under unguessable IDs until they are fetched, or
+// until they expire.
+type blobStore struct {
+	store store
+	ttl   time.Duration
+
+	// mutex makes taking a body and removing it one step, so that concurrent requests
+	// cannot both fetch it.
+	mutex sync.Mutex
+}
+
+var blobs *blobStore
+
+func newBlobStore(dir string, ttl time.Duration) *blobStore {
+	b := &blobStore{
+		store: newStore(dir),
+		ttl:   ttl,
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			b.expire()
+		}
+	}()
+
+	return b
+}
+
+// payloadSize returns the size of the APNs payload that a message would be sent as.
+func payloadSize(m *message) int {
+	bytes, _ := json.Marshal(m.notification().Payload)
+	return len(bytes)
+}
+
+// offload replaces the body of a message with a URL that it can be fetched from, in u,
+// and its SHA-256 hash, in h. The body is kept until the message expires, but not for
+// longer than the configured time to live. Each copy of a message for a device is
+// offloaded separately, as the body can only be fetched once, so the fields are copied
+// first, as they are shared with the copies for other devices.
+func (b *blobStore) offload(m *message, body []byte, baseURL string) error {
+	var id [16]byte
+	rand.Read(id[:])
+	key := base64.RawURLEncoding.EncodeToString(id[:])
+
+	expires := time.Now().Add(b.ttl)
+	if !m.Expiration.IsZero() && m.Expiration.Add(offloadGrace).Before(expires) {
+		expires = m.Expiration.Add(offloadGrace)
+	}
+
+	value, _ := json.Marshal(&blob{Data: body, Expires: expires})
+	if err := b.store.Put(key, value); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(body)
+
+	fields := make(map[string]string, len(m.Fields)+1)
+	for name, value := range m.Fields {
+		fields[name] = value
+	}
+
+	delete(fields, "p")
+	fields["u"] = baseURL + "/blob/" + key
+	fields["h"] = encode85(hash[:])
+	m.Fields = fields
+
+	log.Printf("Offloaded %d byte body of message %s as %s\n", len(body), m.ID, key)
+
+	return nil
+}
+
+// take returns an offloaded body and removes it, so that it can only be fetched once.
+func (b *blobStore) take(key string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	data, ok := b.peek(key)
+	if ok {
+		b.store.Delete(key)
+	}
+	return data, ok
+}
+
+// peek returns an offloaded body without removing it.
+func (b *blobStore) peek(key string) ([]byte, bool) {
+	value, ok := b.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	var stored blob
+	if err := json.Unmarshal(value, &stored); err != nil {
+		log.Println("Error reading blob:", err)
+		return nil, false
+	}
+
+	if time.Now().After(stored.Expires) {
+		return nil, false
+	}
+
+	return stored.Data, true
+}
+
+func (b *blobStore) expire() {
+	keys, err := b.store.Keys()
+	if err != nil {
+		log.Println("Error listing blobs:", err)
+		return
+	}
+
+	for _, key := range keys {
+		value, ok := b.store.Get(key)
+		if !ok {
+			continue
+		}
+
+		var stored blob
+		if err := json.Unmarshal(value, &stored); err != nil || time.Now().After(stored.Expires) {
+			b.store.Delete(key)
+		}
+	}
+}
+
+// blobHandler serves GET /blob/<id>, which returns an offloaded body once.
+func blobHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.Header().Set("Allow", "GET")
+		writer.WriteHeader(405)
+		return
+	}
+
+	key := strings.TrimPrefix(request.URL.Path, "/blob/")
+
+	data, ok := blobs.take(key)
+	if !ok {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Not found")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Write(data)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a connection has to send its PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// trustedProxies are the networks of the proxies in front of the relay, as set by
+// TRUSTED_PROXIES. The client addresses they give in X-Forwarded-For and Forwarded
+// headers, and in PROXY protocol headers, are believed.
+var trustedProxies []*net.IPNet
+
+// flyClientIP is whether the relay runs on Fly.io, whose proxy gives the address of the
+// client in the Fly-Client-IP header.
+var flyClientIP bool
+
+// loadProxyConfiguration reads the proxies to trust from the environment.
+func loadProxyConfiguration() {
+	var err error
+	if trustedProxies, err = parseNetworks(env("TRUSTED_PROXIES", "")); err != nil {
+		log.Fatalf("Invalid address in TRUSTED_PROXIES: %v\n", err)
+	}
+
+	flyClientIP = env("FLY_APP_NAME", "") != ""
+}
+
+// clientIP returns the address of the client that sent a request, as given by the proxy
+// it came through, if that is trusted.
+func clientIP(request *http.Request) net.IP {
+	if flyClientIP {
+		if ip := net.ParseIP(request.Header.Get("Fly-Client-IP")); ip != nil {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	if contains(trustedProxies, ip) {
+		if forwarded := forwardedFor(request); forwarded != nil {
+			return forwarded
+		}
+	}
+
+	return ip
+}
+
+// parseNetworks parses a comma-separated list of addresses and networks in CIDR notation.
+// Single addresses are taken as networks of just that address.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client address given by trusted proxies in the Forwarded or
+// X-Forwarded-For header of a request from one of them. Each proxy appends the address
+// it received the request from, so the addresses are read from the last, skipping the
+// trusted proxies, as the ones before the first untrusted one may have been made up by
+// the client.
+func forwardedFor(request *http.Request) net.IP {
+	var addresses []string
+
+	if values := request.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+					addresses = append(addresses, parts[1])
+				}
+			}
+		}
+	} else {
+		for _, value := range request.Header.Values("X-Forwarded-For") {
+			addresses = append(addresses, strings.Split(value, ",")...)
+		}
+	}
+
+	var ip net.IP
+	for i := len(addresses) - 1; i >= 0; i-- {
+		next := parseForwardedAddress(addresses[i])
+		if next == nil {
+			break
+		}
+
+		ip = next
+		if !contains(trustedProxies, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// parseForwardedAddress parses an address as given in a Forwarded or X-Forwarded-For
+// header, which may be quoted, and have a port, with IPv6 addresses in brackets.
+func parseForwardedAddress(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+
+	return net.ParseIP(strings.Trim(value, "[]"))
+}
+
+// proxyListener accepts connections that start with a PROXY protocol header, version 1 or
+// 2, as sent by HAProxy and others, and gives them the client address from the header.
+// If proxies are trusted, connections from elsewhere are taken as they are.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(trustedProxies) > 0 {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !contains(trustedProxies, addr.IP) {
+			return conn, nil
+		}
+	}
+
+	// The header is read when the connection is first used, which is in its own
+	// goroutine, so that slow clients do not hold up accepting others.
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			log.Printf("Invalid PROXY protocol header from %v: %v\n", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol header, and returns the client address from
+// it, or nil if the proxy did not give one, as for its own health checks.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(reader)
+	}
+
+	return nil, errors.New("Missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a header of the form
+// PROXY TCP4|TCP6|UNKNOWN <source> <destination> <source-port> <destination-port>\r\n.
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long, including the line ending.
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errors.New("Invalid address in PROXY protocol header")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 reads a binary header: the signature, the version and command, the
+// address family and protocol, the length of the addresses, and the addresses.
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, errors.New("Unsupported PROXY protocol version")
+	}
+
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is used for connections made by the proxy itself.
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if len(addresses) < 12 {
+			return nil, errors.New("Short IPv4 address in PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 2:
+		if len(addresses) < 36 {
+			return nil, errors.New("Short IPv6 address in PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	default:
+		// Other address families, such as Unix sockets, have no client address to use.
+		return nil, nil
+	}
+}
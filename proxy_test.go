@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		valid  bool
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n", "203.0.113.7:51234", true},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n", "[2001:db8::7]:51234", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN 203.0.113.7 10.0.0.1 51234 443\r\n", "", true},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n", "", false},
+		{"PROXY UDP4 203.0.113.7 10.0.0.1 51234 443\r\n", "", false},
+		{"PROXY TCP4 not-an-address 10.0.0.1 51234 443\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 port 443\r\n", "", false},
+		{"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7", "", false},
+		{"GET / HTTP/1.1\r\n\r\n", "", false},
+	}
+
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(reader)
+
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%q: unexpected error: %v", test.header, err)
+		case !test.valid && err == nil:
+			t.Errorf("%q: accepted", test.header)
+		case test.valid && test.want == "" && addr != nil:
+			t.Errorf("%q: address = %v, want none", test.header, addr)
+		case test.valid && test.want != "" && (addr == nil || addr.String() != test.want):
+			t.Errorf("%q: address = %v, want %s", test.header, addr, test.want)
+		}
+
+		if test.valid {
+			if rest, _ := reader.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%q: left %q to read", test.header, rest)
+			}
+		}
+	}
+}
+
+// proxyHeaderV2 returns a binary PROXY protocol header.
+func proxyHeaderV2(command, family byte, addresses []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0xc8, 0x22, 0x01, 0xbb)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+		valid  bool
+	}{
+		{"IPv4", proxyHeaderV2(0x21, 0x11, ipv4), "203.0.113.7:51234", true},
+		{"IPv6", proxyHeaderV2(0x21, 0x21, ipv6), "[2001:db8::7]:51234", true},
+		{"IPv4 with TLVs", proxyHeaderV2(0x21, 0x11, append(ipv4, 0x04, 0, 1, 0)), "203.0.113.7:51234", true},
+		{"LOCAL", proxyHeaderV2(0x20, 0x11, ipv4), "", true},
+		{"Unix socket", proxyHeaderV2(0x21, 0x31, make([]byte, 216)), "", true},
+		{"version 1 in binary", proxyHeaderV2(0x11, 0x11, ipv4), "", false},
+		{"short IPv4", proxyHeaderV2(0x21, 0x11, ipv4[:8]), "", false},
+		{"short IPv6", proxyHeaderV2(0x21, 0x21, ipv6[:32]), "", false},
+		{"truncated addresses", proxyHeaderV2(0x21, 0x11, ipv4)[:20], "", false},
+		{"truncated header", proxyHeaderV2(0x21, 0x11, ipv4)[:14], "", false},
+	}
+
+	for _, test := range tests {
+		// Invalid headers are given nothing after them, so that truncated ones cannot be
+		// completed by the request that follows.
+		data := test.header
+		if test.valid {
+			data = append(data, "GET / HTTP/1.1\r\n"...)
+		}
+		reader := bufio.NewReader(bytes.NewReader(data))
+		addr, err := readProxyHeader(reader)
+
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case !test.valid && err == nil:
+			t.Errorf("%s: accepted", test.name)
+		case test.valid && test.want == "" && addr != nil:
+			t.Errorf("%s: address = %v, want none", test.name, addr)
+		case test.valid && test.want != "" && (addr == nil || addr.String() != test.want):
+			t.Errorf("%s: address = %v, want %s", test.name, addr, test.want)
+		}
+
+		if test.valid {
+			if rest, _ := reader.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s: left %q to read", test.name, rest)
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var err error
+	if trustedProxies, err = parseNetworks("10.0.0.0/8, 2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		name          string
+		remote        string
+		forwarded     string
+		xForwardedFor []string
+		want          string
+	}{
+		{"direct", "203.0.113.7:1234", "", nil, "203.0.113.7"},
+		{"untrusted proxy", "203.0.113.7:1234", "", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:1234", "", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:1234", "", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"made up by client", "10.0.0.2:1234", "", []string{"192.0.2.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2:1234", "", []string{"192.0.2.1, 198.51.100.1", "10.0.0.3"}, "198.51.100.1"},
+		{"only proxies", "10.0.0.2:1234", "", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"invalid address", "10.0.0.2:1234", "", []string{"198.51.100.1, garbage"}, "10.0.0.2"},
+		{"no header", "10.0.0.2:1234", "", nil, "10.0.0.2"},
+		{"Forwarded", "10.0.0.2:1234", `for=192.0.2.1, for="198.51.100.1:4711";proto=https`, nil, "198.51.100.1"},
+		{"Forwarded IPv6", "10.0.0.2:1234", `for="[2001:db8::7]:4711"`, nil, "2001:db8::7"},
+		{"Forwarded before X-Forwarded-For", "10.0.0.2:1234", "for=198.51.100.1", []string{"192.0.2.1"}, "198.51.100.1"},
+		{"Forwarded obfuscated", "10.0.0.2:1234", "for=_hidden", nil, "10.0.0.2"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/relay-to/production/token", nil)
+		request.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			request.Header.Set("Forwarded", test.forwarded)
+		}
+		for _, value := range test.xForwardedFor {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+
+		if got := clientIP(request); got.String() != test.want {
+			t.Errorf("%s: clientIP = %v, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+var errQueueFull = errors.New("Queue full")
+
+var (
+	// queue holds messages that have been accepted but not yet delivered. It is nil if
+	// messages are delivered synchronously by the request handler.
+	queue chan *message
+
+	// journal keeps a copy of each queued message until it has been delivered, so that
+	// messages survive restarts. It is nil if messages are only queued in memory.
+	journal store
+)
+
+// startWorkers sets up the queue and the given number of workers that deliver the
+// messages in it concurrently. If a journal directory is given, messages left in it
+// by a previous run are queued again, unless they have expired.
+func startWorkers(workers, size int, journalDir string) {
+	queue = make(chan *message, size)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for m := range queue {
+				deliverWithRetries(context.Background(), m)
+				if journal != nil {
+					if err := journal.Delete(m.ID); err != nil {
+						log.Println("Error removing message from journal:", err)
+					}
+				}
+			}
+		}()
+	}
+
+	log.Printf("Delivering asynchronously with %d workers and a queue of %d\n", workers, size)
+
+	if journalDir != "" {
+		journal = newStore(journalDir)
+		replayJournal()
+	}
+}
+
+// enqueue adds a message to the queue, and returns false if the queue is full or the
+// message could not be written to the journal.
+func enqueue(m *message) bool {
+	if journal != nil {
+		value, _ := json.Marshal(m)
+		if err := journal.Put(m.ID, value); err != nil {
+			log.Println("Error writing message to journal:", err)
+			return false
+		}
+	}
+
+	select {
+	case queue <- m:
+		return true
+	default:
+		if journal != nil {
+			journal.Delete(m.ID)
+		}
+		return false
+	}
+}
+
+func replayJournal() {
+	keys, err := journal.Keys()
+	if err != nil {
+		log.Fatal("Error reading journal: ", err)
+	}
+
+	replayed := 0
+	for _, key := range keys {
+		value, ok := journal.Get(key)
+		if !ok {
+			continue
+		}
+
+		var m message
+		if err := json.Unmarshal(value, &m); err != nil {
+			log.Printf("Dropping unreadable message %s from journal: %v\n", key, err)
+			journal.Delete(key)
+			continue
+		}
+
+		if !m.Expiration.IsZero() && m.Expiration.Before(time.Now()) {
+			log.Printf("Dropping message %s to %s, which expired at %v\n", m.ID, m.DeviceToken, m.Expiration)
+			journal.Delete(key)
+			continue
+		}
+
+		// This blocks if there are more messages than fit in the queue, until the
+		// workers have made room for them.
+		queue <- &m
+		replayed++
+	}
+
+	if replayed > 0 {
+		log.Printf("Replayed %d messages from journal\n", replayed)
+	}
+}
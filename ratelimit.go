@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits how often something identified by a key, such as a client IP
+// address, may push, with a token bucket for each key. Each bucket holds up to burst
+// tokens, and is refilled at rate tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Rate limits by client IP address, VAPID key and device token, as set by
+// RATE_LIMIT_IP, RATE_LIMIT_VAPID and RATE_LIMIT_TOKEN. They are nil if not limited.
+var (
+	ipLimiter    *rateLimiter
+	vapidLimiter *rateLimiter
+	tokenLimiter *rateLimiter
+)
+
+// Deny-lists of client networks and VAPID keys, as set by DENY_IPS and DENY_VAPID_KEYS.
+var (
+	deniedNetworks []*net.IPNet
+	deniedKeys     map[string]bool
+)
+
+// parseRateLimit parses a rate limit of the form <count>/<duration>, such as 60/1m, which
+// allows bursts of up to count pushes, and count pushes per duration on average. An empty
+// limit returns nil.
+func parseRateLimit(value string) (*rateLimiter, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Rate limit must be of the form <count>/<duration>")
+	}
+
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return nil, errors.New("Invalid count in rate limit: " + parts[0])
+	}
+
+	duration, err := time.ParseDuration(parts[1])
+	if err != nil || duration <= 0 {
+		return nil, errors.New("Invalid duration in rate limit: " + parts[1])
+	}
+
+	l := &rateLimiter{
+		rate:    float64(count) / duration.Seconds(),
+		burst:   float64(count),
+		buckets: make(map[string]*bucket),
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			l.expire()
+		}
+	}()
+
+	return l, nil
+}
+
+func envRateLimit(name string) *rateLimiter {
+	l, err := parseRateLimit(env(name, ""))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v\n", name, err)
+	}
+	return l
+}
+
+// loadAbuseControls reads the rate limits and deny-lists from the environment.
+func loadAbuseControls() {
+	ipLimiter = envRateLimit("RATE_LIMIT_IP")
+	vapidLimiter = envRateLimit("RATE_LIMIT_VAPID")
+	tokenLimiter = envRateLimit("RATE_LIMIT_TOKEN")
+
+	var err error
+	if deniedNetworks, err = parseNetworks(env("DENY_IPS", "")); err != nil {
+		log.Fatalf("Invalid address in DENY_IPS: %v\n", err)
+	}
+
+	deniedKeys = make(map[string]bool)
+	for _, key := range strings.Split(env("DENY_VAPID_KEYS", ""), ",") {
+		if key = strings.TrimRight(strings.TrimSpace(key), "="); key != "" {
+			deniedKeys[key] = true
+		}
+	}
+}
+
+// allow takes a token from the bucket for a key, and returns whether there was one. If
+// not, it also returns how long until there will be.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// expire forgets the buckets that have filled up again, as they are the same as new ones.
+func (l *rateLimiter) expire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func deniedIP(ip net.IP) bool {
+	return contains(deniedNetworks, ip)
+}
+
+// writeRateLimited rejects a push that exceeded a rate limit, telling the sender when to
+// try again.
+func writeRateLimited(writer http.ResponseWriter, kind, key string, wait time.Duration) {
+	rateLimited.Add(kind, 1)
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writer.WriteHeader(429)
+	fmt.Fprintln(writer, "Too many requests")
+	log.Printf("Rate limited by %s: %s\n", kind, key)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTargets is the most devices a registration can deliver to.
+const maxTargets = 16
+
+// registration maps a stable subscription ID to the devices that pushes to it are
+// delivered to. The app updates the device token when it changes, so that endpoints
+// using the ID keep working without instances having to subscribe again. A registration
+// with several targets, such as a phone and a tablet of the same user, delivers each
+// push to all of them.
+type registration struct {
+	ID      string   `json:"id"`
+	App     string   `json:"app,omitempty"`
+	Targets []target `json:"targets"`
+
+	// Mailbox is whether pushes are also kept in a mailbox for the app to fetch.
+	Mailbox bool `json:"mailbox,omitempty"`
+
+	// ServerKey is the application server key that pushes must be authorized by, if any,
+	// in canonical form. It is kept here rather than in the endpoint URL, where the
+	// sender could remove or replace it.
+	ServerKey string `json:"key,omitempty"`
+
+	// SecretHash is the SHA-256 hash of the secret that the app authenticates changes to
+	// the registration with.
+	SecretHash string `json:"secret_hash"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// registryStore keeps registrations keyed by ID.
+type registryStore struct {
+	store store
+
+	// mutex serializes changes to registrations, which are read, modified and written
+	// back by both the registration endpoints and deliveries pruning gone targets.
+	mutex sync.Mutex
+}
+
+var (
+	// registry is nil unless registry mode is enabled by REGISTRY_DIR.
+	registry *registryStore
+
+	// registryToken is required to create registrations, as their endpoints are not
+	// signed, and so must only be handed out to the app.
+	registryToken string
+)
+
+var (
+	errUnknownTarget = errors.New("Unknown target")
+	errLastTarget    = errors.New("Last target")
+)
+
+func newRegistryStore(s store) *registryStore {
+	return &registryStore{store: s}
+}
+
+func (r *registryStore) Get(id string) (*registration, bool) {
+	value, ok := r.store.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	var reg registration
+	if err := json.Unmarshal(value, &reg); err != nil {
+		log.Println("Error reading registration:", err)
+		return nil, false
+	}
+
+	return &reg, true
+}
+
+func (r *registryStore) Put(reg *registration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.put(reg)
+}
+
+func (r *registryStore) put(reg *registration) error {
+	value, _ := json.Marshal(reg)
+	return r.store.Put(reg.ID, value)
+}
+
+func (r *registryStore) Delete(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.store.Delete(id)
+}
+
+// update changes a registration with the given function, and stores it unless the
+// function fails.
+func (r *registryStore) update(id string, change func(*registration) error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	reg, ok := r.Get(id)
+	if !ok {
+		return errors.New("Unknown subscription: " + id)
+	}
+
+	if err := change(reg); err != nil {
+		return err
+	}
+
+	reg.Updated = time.Now()
+	return r.put(reg)
+}
+
+// prune removes a device token that turned out to be gone from a registration. The last
+// device is kept, as its tombstone already keeps pushes from being sent to it, and the
+// registration would otherwise be left without any until the app updates it.
+func (r *registryStore) prune(id, deviceToken string) {
+	err := r.update(id, func(reg *registration) error {
+		if len(reg.Targets) == 1 && reg.Targets[0].DeviceToken == deviceToken {
+			return errLastTarget
+		}
+		return reg.removeTarget(deviceToken)
+	})
+
+	if err == nil {
+		fanOutResults.Add("pruned", 1)
+		log.Printf("Pruned %s from subscription %s\n", deviceToken, id)
+	} else if err != errUnknownTarget && err != errLastTarget {
+		log.Printf("Error pruning %s from subscription %s: %v\n", deviceToken, id, err)
+	}
+}
+
+func (reg *registration) removeTarget(deviceToken string) error {
+	for i, t := range reg.Targets {
+		if t.DeviceToken == deviceToken {
+			reg.Targets = append(reg.Targets[:i], reg.Targets[i+1:]...)
+			return nil
+		}
+	}
+	return errUnknownTarget
+}
+
+func randomString() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// registeredEndpoint returns the endpoint for a push to /push/<id>[/extra].
+func registeredEndpoint(path string) (*endpoint, error) {
+	if registry == nil {
+		return nil, errors.New("Registry is not enabled")
+	}
+
+	components := strings.SplitN(strings.TrimPrefix(path, "/push/"), "/", 2)
+
+	reg, ok := registry.Get(components[0])
+	if !ok {
+		return nil, errors.New("Unknown subscription: " + components[0])
+	}
+
+	// A registration may be left without devices until the app adds new ones, and its
+	// endpoint keeps working meanwhile.
+	e := &endpoint{
+		app:          defaultApp,
+		serverKey:    reg.ServerKey,
+		opaque:       true,
+		registration: reg.ID,
+		targets:      reg.Targets,
+		mailbox:      reg.Mailbox && mailboxes != nil,
+	}
+
+	if len(reg.Targets) > 0 {
+		e.environment = reg.Targets[0].Environment
+		e.deviceToken = reg.Targets[0].DeviceToken
+	}
+
+	if reg.App != "" {
+		if e.app = apps[reg.App]; e.app == nil {
+			return nil, errors.New("Unknown app in registration: " + reg.App)
+		}
+	}
+
+	if len(components) > 1 {
+		e.extra = components[1]
+	}
+
+	return e, nil
+}
+
+// registrationRequest is the body of a request to create or change a registration. A
+// single target is given by its environment and token, and several by targets.
+type registrationRequest struct {
+	App         string   `json:"app"`
+	Environment string   `json:"environment"`
+	DeviceToken string   `json:"token"`
+	Targets     []target `json:"targets"`
+	Mailbox     *bool    `json:"mailbox"`
+
+	// ServerKey binds the registration to an application server key, or unbinds it if
+	// empty. It is left as it is if not given.
+	ServerKey *string `json:"key"`
+
+	// Previous is the device token that a new one replaces, which is needed to update a
+	// registration with several targets.
+	Previous string `json:"previous"`
+}
+
+// targets returns the targets of a registration request, or an error if any of them is
+// incomplete.
+func (r *registrationRequest) targets() ([]target, error) {
+	targets := r.Targets
+	if r.DeviceToken != "" {
+		targets = append(targets, target{Environment: r.Environment, DeviceToken: r.DeviceToken})
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("Invalid registration: environment and token are required")
+	}
+
+	if len(targets) > maxTargets {
+		return nil, errors.New(fmt.Sprintf("Invalid registration: more than %d targets", maxTargets))
+	}
+
+	for _, t := range targets {
+		if t.Environment == "" || t.DeviceToken == "" {
+			return nil, errors.New("Invalid registration: environment and token are required")
+		}
+		if !t.valid() {
+			return nil, errors.New("Invalid registration: invalid device token " + t.DeviceToken)
+		}
+	}
+
+	return targets, nil
+}
+
+// registryHandler serves the registration endpoints:
+//
+//	POST   /subscriptions                      registers devices, and returns an ID and secret
+//	PUT    /subscriptions/<id>                 changes a device token, or replaces all targets
+//	DELETE /subscriptions/<id>                 deletes a registration
+//	POST   /subscriptions/<id>/targets         adds a device
+//	DELETE /subscriptions/<id>/targets/<token> removes a device
+//
+// Changes to a registration must be authorized with its secret, as a bearer token.
+func registryHandler(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/subscriptions"), "/")
+	components := strings.Split(path, "/")
+	id := components[0]
+
+	if id == "" {
+		if request.Method != "POST" {
+			writer.WriteHeader(405)
+			return
+		}
+
+		createRegistration(writer, request)
+		return
+	}
+
+	reg, ok := registry.Get(id)
+	if !ok {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Unknown subscription:", id)
+		return
+	}
+
+	if !authorizeRegistration(writer, request, reg) {
+		return
+	}
+
+	var change func(*registration) error
+
+	switch {
+	case len(components) == 1 && request.Method == "DELETE":
+		if err := registry.Delete(id); err != nil {
+			writer.WriteHeader(500)
+			fmt.Fprintln(writer, "Error deleting registration:", err)
+			log.Println("Error deleting registration:", err)
+			return
+		}
+
+		if mailboxes != nil {
+			mailboxes.Delete(id)
+		}
+
+		if streams != nil {
+			for _, t := range reg.Targets {
+				if t.Environment == environmentStream {
+					streams.buffers.Delete(streamKey(id, t.DeviceToken))
+				}
+			}
+		}
+
+		log.Println("Deleted subscription", id)
+		writer.WriteHeader(204)
+		return
+	case len(components) == 1 && request.Method == "PUT":
+		var r registrationRequest
+		if err := json.NewDecoder(request.Body).Decode(&r); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Invalid registration:", err)
+			return
+		}
+
+		change = func(reg *registration) error {
+			return reg.replace(&r)
+		}
+	case len(components) == 2 && components[1] == "targets" && request.Method == "POST":
+		var t target
+		if err := json.NewDecoder(request.Body).Decode(&t); err != nil || t.Environment == "" || !t.valid() {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Invalid target: environment and a valid token are required")
+			return
+		}
+
+		change = func(reg *registration) error {
+			reg.removeTarget(t.DeviceToken)
+			if len(reg.Targets) >= maxTargets {
+				return errors.New(fmt.Sprintf("Invalid registration: more than %d targets", maxTargets))
+			}
+			reg.Targets = append(reg.Targets, t)
+			return nil
+		}
+	case len(components) == 3 && components[1] == "targets" && request.Method == "DELETE":
+		change = func(reg *registration) error {
+			return reg.removeTarget(components[2])
+		}
+	default:
+		writer.WriteHeader(405)
+		return
+	}
+
+	if err := registry.update(id, change); err != nil {
+		if err == errUnknownTarget {
+			writer.WriteHeader(404)
+		} else {
+			writer.WriteHeader(400)
+		}
+		fmt.Fprintln(writer, err)
+		log.Printf("Error changing subscription %s: %v\n", id, err)
+		return
+	}
+
+	log.Printf("Updated subscription %s\n", id)
+	writer.WriteHeader(204)
+}
+
+func createRegistration(writer http.ResponseWriter, request *http.Request) {
+	authorization := request.Header.Get("Authorization")
+	if registryToken == "" || subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+registryToken)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(401)
+		fmt.Fprintln(writer, "Unauthorized")
+		log.Println("Unauthorized request to register")
+		return
+	}
+
+	var r registrationRequest
+	if err := json.NewDecoder(request.Body).Decode(&r); err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Invalid registration:", err)
+		return
+	}
+
+	targets, err := r.targets()
+	if err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, err)
+		return
+	}
+
+	if r.App != "" && apps[r.App] == nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Unknown app:", r.App)
+		return
+	}
+
+	var serverKey string
+	if r.ServerKey != nil {
+		if serverKey, err = canonicalServerKey(*r.ServerKey); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, err)
+			return
+		}
+	}
+
+	secret := randomString()
+	reg := &registration{
+		ID:         randomString(),
+		App:        r.App,
+		Targets:    targets,
+		Mailbox:    r.Mailbox != nil && *r.Mailbox,
+		ServerKey:  serverKey,
+		SecretHash: hashSecret(secret),
+		Created:    time.Now(),
+		Updated:    time.Now(),
+	}
+
+	if err := registry.Put(reg); err != nil {
+		writer.WriteHeader(500)
+		fmt.Fprintln(writer, "Error storing registration:", err)
+		log.Println("Error storing registration:", err)
+		return
+	}
+
+	log.Printf("Registered subscription %s for %d devices\n", reg.ID, len(reg.Targets))
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(201)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"id":       reg.ID,
+		"secret":   secret,
+		"endpoint": origin(request) + "/push/" + reg.ID,
+	})
+}
+
+// replace applies an update request to a registration. Given targets replace all of
+// them, and a single token replaces the previous one, which may be left out if the
+// registration has only one target. The mailbox and server key can be changed on their
+// own.
+func (reg *registration) replace(r *registrationRequest) error {
+	if r.ServerKey != nil {
+		key, err := canonicalServerKey(*r.ServerKey)
+		if err != nil {
+			return err
+		}
+		reg.ServerKey = key
+	}
+
+	if r.Mailbox != nil {
+		reg.Mailbox = *r.Mailbox
+		if !reg.Mailbox && mailboxes != nil {
+			mailboxes.Delete(reg.ID)
+		}
+	}
+
+	if r.DeviceToken == "" && r.Targets == nil && (r.Mailbox != nil || r.ServerKey != nil) {
+		return nil
+	}
+
+	if r.DeviceToken == "" {
+		targets, err := r.targets()
+		if err != nil {
+			return err
+		}
+		reg.Targets = targets
+		return nil
+	}
+
+	index := -1
+	switch {
+	case r.Previous != "":
+		for i, t := range reg.Targets {
+			if t.DeviceToken == r.Previous {
+				index = i
+			}
+		}
+		if index < 0 {
+			return errUnknownTarget
+		}
+	case len(reg.Targets) == 1:
+		index = 0
+	case len(reg.Targets) == 0:
+		targets, err := r.targets()
+		if err != nil {
+			return err
+		}
+		reg.Targets = targets
+		return nil
+	default:
+		return errors.New("Invalid registration: the previous token is needed to update one of several targets")
+	}
+
+	if r.Environment != "" {
+		reg.Targets[index].Environment = r.Environment
+	}
+	reg.Targets[index].DeviceToken = r.DeviceToken
+
+	return nil
+}
+
+func authorizeRegistration(writer http.ResponseWriter, request *http.Request, reg *registration) bool {
+	secret := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(reg.SecretHash)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(401)
+		fmt.Fprintln(writer, "Unauthorized")
+		log.Println("Unauthorized change to subscription", reg.ID)
+		return false
+	}
+
+	return true
+}
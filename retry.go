@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// The retry policy for transient failures, as set by RETRY_ATTEMPTS, RETRY_BASE_DELAY,
+// RETRY_MAX_DELAY and RETRY_SYNC_LIMIT. The last limits how long a push sender is kept
+// waiting for retries when pushes are delivered without a queue.
+var (
+	retryAttempts  = 3
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+	retrySyncLimit = 10 * time.Second
+)
+
+// retryable returns whether a failed attempt at sending a notification might succeed if
+// tried again. Network errors and APNs being overloaded or unavailable are transient,
+// while all other reasons are permanent.
+func retryable(res *apns2.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch res.Reason {
+	case apns2.ReasonTooManyRequests, apns2.ReasonInternalServerError, apns2.ReasonServiceUnavailable, apns2.ReasonShutdown:
+		return true
+	case "":
+		return res.StatusCode == 429 || res.StatusCode == 500 || res.StatusCode == 503
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the given retry, which doubles with each attempt,
+// and is jittered so that retries after an outage do not all arrive at once.
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// deliverWithRetries delivers a message, retrying transient failures until the attempts
+// run out, or the message would expire or the context end before the next attempt.
+// Messages that could not be delivered are recorded as dead letters.
+func deliverWithRetries(ctx context.Context, m *message) (*apns2.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			pushRetries.Add(1)
+		}
+
+		res, err := deliver(m)
+		if err == nil && res.Sent() {
+			return res, err
+		}
+
+		if !retryable(res, err) || attempt >= retryAttempts {
+			deadLetters.Put(m, res, err, attempt)
+			return res, err
+		}
+
+		delay := backoff(attempt)
+		if !m.Expiration.IsZero() && time.Now().Add(delay).After(m.Expiration) {
+			log.Printf("Not retrying message %s, which expires at %v\n", m.ID, m.Expiration)
+			deadLetters.Put(m, res, err, attempt)
+			return res, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			log.Printf("Not retrying message %s, as the push sender can't wait %v\n", m.ID, delay)
+			deadLetters.Put(m, res, err, attempt)
+			return res, err
+		}
+
+		log.Printf("Retrying message %s in %v after attempt %d of %d\n", m.ID, delay, attempt, retryAttempts)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("Not retrying message %s, as the push sender is gone\n", m.ID)
+			deadLetters.Put(m, res, err, attempt)
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealingKey is a server key that endpoints are sealed with. Each key has an ID that is
+// included in the endpoints sealed with it, so that keys can be rotated by adding a
+// new key first in ENDPOINT_KEYS while keeping the old ones for existing endpoints.
+type sealingKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	// sealingKeys are the keys that sealed endpoints are opened with. The first one is
+	// used for sealing new endpoints.
+	sealingKeys []*sealingKey
+
+	// rawEndpoints is whether endpoints with the device token in plain text are accepted.
+	rawEndpoints = true
+)
+
+// sealedEndpoint is the contents of a sealed endpoint, before encryption.
+type sealedEndpoint struct {
+	App         string `json:"a,omitempty"`
+	Environment string `json:"e"`
+	DeviceToken string `json:"t"`
+	Extra       string `json:"x,omitempty"`
+	ServerKey   string `json:"k,omitempty"`
+}
+
+// loadSealingKeys parses a comma-separated list of keys, each given as an ID and a
+// base64 encoded 256-bit AES key separated by a colon.
+func loadSealingKeys(value string) ([]*sealingKey, error) {
+	var keys []*sealingKey
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], ".") {
+			return nil, errors.New("Keys must be given as <id>:<base64 key>, with no dots in the ID")
+		}
+
+		bytes, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Key %s: %v", parts[0], err)
+		}
+
+		if len(bytes) != 32 {
+			return nil, fmt.Errorf("Key %s is %d bytes, not 32", parts[0], len(bytes))
+		}
+
+		block, _ := aes.NewCipher(bytes)
+		aead, _ := cipher.NewGCM(block)
+		keys = append(keys, &sealingKey{id: parts[0], aead: aead})
+	}
+
+	return keys, nil
+}
+
+// sealEndpoint encrypts the contents of an endpoint with the current key, and returns
+// it as <key-id>.<base64url data>, where the data is the nonce followed by the
+// ciphertext. The key ID is authenticated along with the ciphertext.
+func sealEndpoint(contents *sealedEndpoint) (string, error) {
+	if len(sealingKeys) == 0 {
+		return "", errors.New("No keys to seal endpoints with")
+	}
+	key := sealingKeys[0]
+
+	plaintext, _ := json.Marshal(contents)
+
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+	rand.Read(nonce)
+	sealed := key.aead.Seal(nonce, nonce, plaintext, []byte(key.id))
+
+	return key.id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openEndpoint decrypts a sealed endpoint, and rejects it if it was tampered with.
+func openEndpoint(value string) (*endpoint, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid sealed endpoint")
+	}
+
+	var key *sealingKey
+	for _, k := range sealingKeys {
+		if k.id == parts[0] {
+			key = k
+		}
+	}
+
+	if key == nil {
+		return nil, errors.New("Unknown key for sealed endpoint: " + parts[0])
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < key.aead.NonceSize() {
+		return nil, errors.New("Invalid sealed endpoint")
+	}
+
+	nonce := sealed[:key.aead.NonceSize()]
+	plaintext, err := key.aead.Open(nil, nonce, sealed[len(nonce):], []byte(key.id))
+	if err != nil {
+		return nil, errors.New("Sealed endpoint failed authentication")
+	}
+
+	var contents sealedEndpoint
+	if err := json.Unmarshal(plaintext, &contents); err != nil {
+		return nil, errors.New("Invalid sealed endpoint contents")
+	}
+
+	e := &endpoint{
+		app:         defaultApp,
+		environment: contents.Environment,
+		deviceToken: contents.DeviceToken,
+		extra:       contents.Extra,
+		serverKey:   contents.ServerKey,
+		opaque:      true,
+	}
+
+	if contents.App != "" {
+		if e.app = apps[contents.App]; e.app == nil {
+			return nil, errors.New("Unknown app in sealed endpoint: " + contents.App)
+		}
+	}
+
+	return e, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testSealingKey(t *testing.T, id string, fill byte) *sealingKey {
+	keys, err := loadSealingKeys(id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(fill), 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys[0]
+}
+
+func TestOpenEndpoint(t *testing.T) {
+	defaultApp = &app{name: "default"}
+	beta := &app{name: "beta"}
+	apps = map[string]*app{"default": defaultApp, "beta": beta}
+
+	oldKey := testSealingKey(t, "1", 'a')
+	newKey := testSealingKey(t, "2", 'b')
+	defer func() { sealingKeys = nil }()
+
+	contents := &sealedEndpoint{App: "beta", Environment: "production", DeviceToken: "abcd", Extra: "x/y", ServerKey: "key"}
+
+	sealingKeys = []*sealingKey{oldKey}
+	sealedWithOld, err := sealEndpoint(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoints sealed with an older key still open after a new one is added.
+	sealingKeys = []*sealingKey{newKey, oldKey}
+	sealed, err := sealEndpoint(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "2.") {
+		t.Errorf("sealed with %q, want the first key", sealed)
+	}
+
+	for _, value := range []string{sealed, sealedWithOld} {
+		e, err := openEndpoint(value)
+		if err != nil {
+			t.Errorf("openEndpoint(%s): %v", value, err)
+			continue
+		}
+		if e.app != beta || e.environment != "production" || e.deviceToken != "abcd" || e.extra != "x/y" || e.serverKey != "key" || !e.opaque {
+			t.Errorf("openEndpoint(%s) = %+v", value, e)
+		}
+	}
+
+	data := sealed[strings.Index(sealed, ".")+1:]
+	bytes, _ := base64.RawURLEncoding.DecodeString(data)
+	tampered := append([]byte(nil), bytes...)
+	tampered[len(tampered)-1] ^= 1
+
+	invalid := []struct {
+		name  string
+		value string
+	}{
+		{"tampered", "2." + base64.RawURLEncoding.EncodeToString(tampered)},
+		{"other known key", "1." + data},
+		{"unknown key", "3." + data},
+		{"no key ID", data},
+		{"not base64", "2.!!!!"},
+		{"too short", "2." + base64.RawURLEncoding.EncodeToString(bytes[:8])},
+		{"empty", ""},
+	}
+
+	for _, test := range invalid {
+		if _, err := openEndpoint(test.value); err == nil {
+			t.Errorf("%s: opened", test.name)
+		}
+	}
+
+	// Endpoints for apps that no longer exist are rejected.
+	apps = map[string]*app{"default": defaultApp}
+	if _, err := openEndpoint(sealed); err == nil {
+		t.Error("opened endpoint for unknown app")
+	}
+}
+
+func TestLoadSealingKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+
+	keys, err := loadSealingKeys(" 2:" + key + ", 1:" + key + ",")
+	if err != nil || len(keys) != 2 || keys[0].id != "2" || keys[1].id != "1" {
+		t.Errorf("loadSealingKeys = %v, %v", keys, err)
+	}
+
+	for _, value := range []string{
+		key,
+		":" + key,
+		"1.0:" + key,
+		"1:not base64",
+		"1:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 16))),
+	} {
+		if _, err := loadSealingKeys(value); err == nil {
+			t.Errorf("loadSealingKeys(%q) accepted", value)
+		}
+	}
+}
+
+func TestParseStreamEndpoint(t *testing.T) {
+	defaultApp = &app{name: "default"}
+	apps = map[string]*app{"default": defaultApp}
+
+	sealingKeys = []*sealingKey{testSealingKey(t, "1", 'a')}
+	defer func() { sealingKeys = nil }()
+
+	sealed, err := sealEndpoint(&sealedEndpoint{App: "default", Environment: environmentStream, DeviceToken: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streams can only be pushed to through registrations, whose clients can connect.
+	for _, path := range []string{"/relay-to/stream/laptop", "/relay-to/default/stream/laptop", "/sealed/" + sealed} {
+		if _, err := parseEndpoint(httptest.NewRequest("POST", path, nil)); err != errStreamNotRegistered {
+			t.Errorf("%s: error = %v, want %v", path, err, errStreamNotRegistered)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// tagLength is the number of bytes of the HMAC that signed endpoints carry.
+const tagLength = 16
+
+// endpointSecrets are the secrets that raw endpoints are signed with. The first one is
+// used for signing new endpoints, and all of them are accepted, so that secrets can be
+// rotated. If there are none, raw endpoints need not be signed.
+var endpointSecrets [][]byte
+
+func loadEndpointSecrets(value string) [][]byte {
+	var secrets [][]byte
+	for _, secret := range strings.Split(value, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	return secrets
+}
+
+// endpointTag returns the HMAC tag of an endpoint under a secret, which covers its app,
+// environment, device token, extra value and application server key.
+func endpointTag(secret []byte, contents *sealedEndpoint) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{contents.App, contents.Environment, contents.DeviceToken, contents.Extra, contents.ServerKey}, "\n")))
+	return mac.Sum(nil)[:tagLength]
+}
+
+// verifyTag checks the tag of a raw endpoint against every secret. All of them are
+// always tried, so that the time taken does not reveal which one matched.
+func verifyTag(e *endpoint) error {
+	if e.tag == "" {
+		return errors.New("Endpoint is not signed")
+	}
+
+	tag, err := base64.RawURLEncoding.DecodeString(e.tag)
+	if err != nil {
+		return errors.New("Invalid endpoint signature")
+	}
+
+	contents := e.contents()
+
+	valid := false
+	for _, secret := range endpointSecrets {
+		if hmac.Equal(tag, endpointTag(secret, contents)) {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return errors.New("Endpoint signature does not verify")
+	}
+
+	return nil
+}
+
+// signedEndpoint returns the path and query of a raw endpoint, signed with the current
+// secret.
+func signedEndpoint(contents *sealedEndpoint) (string, error) {
+	if len(endpointSecrets) == 0 {
+		return "", errors.New("No secrets to sign endpoints with")
+	}
+
+	path := "/relay-to/"
+	if contents.App != "" {
+		path += contents.App + "/"
+	}
+	path += contents.Environment + "/" + contents.DeviceToken
+	if contents.Extra != "" {
+		path += "/" + contents.Extra
+	}
+
+	query := url.Values{}
+	if contents.ServerKey != "" {
+		query.Set("k", contents.ServerKey)
+	}
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(endpointTag(endpointSecrets[0], contents)))
+
+	return path + "?" + query.Encode(), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyTag(t *testing.T) {
+	defaultApp = &app{name: "default"}
+	apps = map[string]*app{"default": defaultApp, "beta": {name: "beta"}}
+	defer func() { endpointSecrets = nil }()
+
+	token := strings.Repeat("ab", 32)
+	contents := &sealedEndpoint{App: "beta", Environment: "production", DeviceToken: token, Extra: "extra", ServerKey: "AAE"}
+
+	endpointSecrets = loadEndpointSecrets("old")
+	signedWithOld, err := signedEndpoint(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoints signed with an older secret still verify after a new one is added.
+	endpointSecrets = loadEndpointSecrets("new, old")
+	signed, err := signedEndpoint(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed == signedWithOld {
+		t.Error("signed with an old secret")
+	}
+
+	verify := func(path string) error {
+		e, err := parseEndpoint(httptest.NewRequest("POST", path, nil))
+		if err != nil {
+			return err
+		}
+		return verifyTag(e)
+	}
+
+	for _, path := range []string{signed, signedWithOld} {
+		if err := verify(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	u, _ := url.Parse(signed)
+	sig := u.Query().Get("sig")
+
+	invalid := []struct {
+		name string
+		path string
+	}{
+		{"no signature", "/relay-to/beta/production/" + token + "/extra?k=AAE"},
+		{"other app", "/relay-to/production/" + token + "/extra?k=AAE&sig=" + sig},
+		{"other environment", "/relay-to/beta/development/" + token + "/extra?k=AAE&sig=" + sig},
+		{"other token", "/relay-to/beta/production/" + strings.Repeat("cd", 32) + "/extra?k=AAE&sig=" + sig},
+		{"other extra", "/relay-to/beta/production/" + token + "/other?k=AAE&sig=" + sig},
+		{"no extra", "/relay-to/beta/production/" + token + "?k=AAE&sig=" + sig},
+		{"key removed", "/relay-to/beta/production/" + token + "/extra?sig=" + sig},
+		{"key replaced", "/relay-to/beta/production/" + token + "/extra?k=AAI&sig=" + sig},
+		{"invalid signature", "/relay-to/beta/production/" + token + "/extra?k=AAE&sig=!!"},
+		{"truncated signature", "/relay-to/beta/production/" + token + "/extra?k=AAE&sig=" + sig[:10]},
+	}
+
+	for _, test := range invalid {
+		if err := verify(test.path); err == nil {
+			t.Errorf("%s: verified", test.name)
+		}
+	}
+
+	// Tags made with a secret that was removed no longer verify.
+	endpointSecrets = loadEndpointSecrets("new")
+	if err := verify(signedWithOld); err == nil {
+		t.Error("verified with a removed secret")
+	}
+}
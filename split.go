@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxFragments is the most notifications a message is split into.
+const maxFragments = 16
+
+// split divides the encoded body of a message that is too large for a single notification
+// into fragments, each sent as its own notification. Every fragment has the message ID
+// in m, its index counting from zero in i, the number of fragments in n, and its part
+// of the encoded body in p. All but the last fragment are sent first as silent
+// notifications, and the last one is sent as the alerting notification, which carries
+// the other fields as usual.
+func split(m *message) error {
+	encoded := m.Fields["p"]
+
+	// Find how much of the body fits in the last, alerting, fragment, which also has the
+	// other fields and so is the largest apart from its part of the body. The silent
+	// fragments are given the same amount, for simplicity.
+	m.Fields["m"] = m.ID
+	m.Fields["i"] = strconv.Itoa(maxFragments)
+	m.Fields["n"] = strconv.Itoa(maxFragments)
+	m.Fields["p"] = ""
+	budget := maxPayloadSize - payloadSize(m)
+
+	silent := map[string]string{"m": m.ID, "i": m.Fields["i"], "n": m.Fields["n"], "p": ""}
+	silentBytes, _ := json.Marshal(m.fragmentNotification(silent).Payload)
+	if maxPayloadSize-len(silentBytes) < budget {
+		budget = maxPayloadSize - len(silentBytes)
+	}
+
+	if budget <= 0 {
+		return errors.New("No room for the body in a notification")
+	}
+
+	var parts []string
+	for len(encoded) > 0 {
+		length := fragmentLength(encoded, budget)
+		parts = append(parts, encoded[:length])
+		encoded = encoded[length:]
+	}
+
+	if len(parts) > maxFragments {
+		return errors.New(fmt.Sprintf("Body would need %d fragments, more than the %d allowed", len(parts), maxFragments))
+	}
+
+	count := strconv.Itoa(len(parts))
+	for i, part := range parts[:len(parts)-1] {
+		m.Fragments = append(m.Fragments, map[string]string{
+			"m": m.ID,
+			"i": strconv.Itoa(i),
+			"n": count,
+			"p": part,
+		})
+	}
+
+	m.Fields["i"] = strconv.Itoa(len(parts) - 1)
+	m.Fields["n"] = count
+	m.Fields["p"] = parts[len(parts)-1]
+
+	return nil
+}
+
+// fragmentLength returns how many characters from the start of an encoded body fit in
+// the given number of bytes of JSON. The z85 characters <, > and & are escaped by the
+// JSON encoder as six bytes each.
+func fragmentLength(encoded string, budget int) int {
+	size := 0
+	for i := 0; i < len(encoded); i++ {
+		switch encoded[i] {
+		case '<', '>', '&':
+			size += 6
+		default:
+			size++
+		}
+
+		if size > budget {
+			return i
+		}
+	}
+	return len(encoded)
+}
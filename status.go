@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// retryAfter is how long push senders are asked to wait before trying again when APNs
+// is overloaded or unavailable, as APNs itself does not say.
+const retryAfter = 60 * time.Second
+
+// reasonStatus translates the reasons APNs gives for rejecting a notification into the
+// RFC 8030 status codes returned to push senders. Senders such as Mastodon only delete
+// a subscription when given 404 or 410, so those are only used when the device token
+// will never work again. Problems with the relay's own requests or credentials are
+// reported as 502, so that subscriptions survive until they are fixed.
+var reasonStatus = map[string]int{
+	apns2.ReasonBadCollapseID:               400,
+	apns2.ReasonBadDeviceToken:              404,
+	apns2.ReasonBadExpirationDate:           400,
+	apns2.ReasonBadMessageID:                502,
+	apns2.ReasonBadPriority:                 502,
+	apns2.ReasonBadTopic:                    502,
+	apns2.ReasonDeviceTokenNotForTopic:      502,
+	apns2.ReasonDuplicateHeaders:            502,
+	apns2.ReasonIdleTimeout:                 503,
+	apns2.ReasonMissingDeviceToken:          404,
+	apns2.ReasonMissingTopic:                502,
+	apns2.ReasonPayloadEmpty:                400,
+	apns2.ReasonTopicDisallowed:             502,
+	apns2.ReasonBadCertificate:              502,
+	apns2.ReasonBadCertificateEnvironment:   502,
+	apns2.ReasonExpiredProviderToken:        502,
+	apns2.ReasonForbidden:                   502,
+	apns2.ReasonInvalidProviderToken:        502,
+	apns2.ReasonMissingProviderToken:        502,
+	apns2.ReasonBadPath:                     502,
+	apns2.ReasonMethodNotAllowed:            502,
+	apns2.ReasonUnregistered:                410,
+	apns2.ReasonPayloadTooLarge:             413,
+	apns2.ReasonTooManyProviderTokenUpdates: 502,
+	apns2.ReasonTooManyRequests:             429,
+	apns2.ReasonInternalServerError:         502,
+	apns2.ReasonServiceUnavailable:          503,
+	apns2.ReasonShutdown:                    503,
+}
+
+// webPushStatus returns the status code to give the push sender for a notification
+// that APNs did not accept.
+func webPushStatus(res *apns2.Response) int {
+	if status, ok := reasonStatus[res.Reason]; ok {
+		return status
+	}
+
+	// Reasons unknown to this version of apns2 are translated by their status code.
+	switch res.StatusCode {
+	case 410, 413, 429, 503:
+		return res.StatusCode
+	default:
+		return 502
+	}
+}
+
+// writeFailure sends the status for a notification that APNs did not accept, along with
+// a Retry-After header if the sender should try again later.
+func writeFailure(writer http.ResponseWriter, res *apns2.Response) {
+	status := webPushStatus(res)
+
+	if status == 429 || status == 503 {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	}
+
+	writer.WriteHeader(status)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sideshow/apns2"
+)
+
+func TestWebPushStatusReasons(t *testing.T) {
+	tests := []struct {
+		reason     string
+		statusCode int
+		want       int
+	}{
+		{apns2.ReasonBadCollapseID, 400, 400},
+		{apns2.ReasonBadDeviceToken, 400, 404},
+		{apns2.ReasonBadExpirationDate, 400, 400},
+		{apns2.ReasonBadMessageID, 400, 502},
+		{apns2.ReasonBadPriority, 400, 502},
+		{apns2.ReasonBadTopic, 400, 502},
+		{apns2.ReasonDeviceTokenNotForTopic, 400, 502},
+		{apns2.ReasonDuplicateHeaders, 400, 502},
+		{apns2.ReasonIdleTimeout, 400, 503},
+		{apns2.ReasonMissingDeviceToken, 400, 404},
+		{apns2.ReasonMissingTopic, 400, 502},
+		{apns2.ReasonPayloadEmpty, 400, 400},
+		{apns2.ReasonTopicDisallowed, 400, 502},
+		{apns2.ReasonBadCertificate, 403, 502},
+		{apns2.ReasonBadCertificateEnvironment, 403, 502},
+		{apns2.ReasonExpiredProviderToken, 403, 502},
+		{apns2.ReasonForbidden, 403, 502},
+		{apns2.ReasonInvalidProviderToken, 403, 502},
+		{apns2.ReasonMissingProviderToken, 403, 502},
+		{apns2.ReasonBadPath, 404, 502},
+		{apns2.ReasonMethodNotAllowed, 405, 502},
+		{apns2.ReasonUnregistered, 410, 410},
+		{apns2.ReasonPayloadTooLarge, 413, 413},
+		{apns2.ReasonTooManyProviderTokenUpdates, 429, 502},
+		{apns2.ReasonTooManyRequests, 429, 429},
+		{apns2.ReasonInternalServerError, 500, 502},
+		{apns2.ReasonServiceUnavailable, 503, 503},
+		{apns2.ReasonShutdown, 503, 503},
+	}
+
+	if len(tests) != len(reasonStatus) {
+		t.Errorf("testing %d reasons, but reasonStatus has %d", len(tests), len(reasonStatus))
+	}
+
+	for _, test := range tests {
+		if _, ok := reasonStatus[test.reason]; !ok {
+			t.Errorf("reasonStatus has no entry for %s", test.reason)
+		}
+
+		res := &apns2.Response{StatusCode: test.statusCode, Reason: test.reason}
+		if got := webPushStatus(res); got != test.want {
+			t.Errorf("webPushStatus(%s) = %d, want %d", test.reason, got, test.want)
+		}
+	}
+}
+
+func TestWebPushStatusUnknownReason(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		want       int
+	}{
+		{400, 502},
+		{403, 502},
+		{404, 502},
+		{410, 410},
+		{413, 413},
+		{429, 429},
+		{500, 502},
+		{503, 503},
+	}
+
+	for _, test := range tests {
+		res := &apns2.Response{StatusCode: test.statusCode, Reason: "SomethingNew"}
+		if got := webPushStatus(res); got != test.want {
+			t.Errorf("webPushStatus(%d SomethingNew) = %d, want %d", test.statusCode, got, test.want)
+		}
+	}
+}
+
+func TestWriteFailureRetryAfter(t *testing.T) {
+	tests := []struct {
+		reason     string
+		want       int
+		retryAfter string
+	}{
+		{apns2.ReasonTooManyRequests, 429, "60"},
+		{apns2.ReasonServiceUnavailable, 503, "60"},
+		{apns2.ReasonShutdown, 503, "60"},
+		{apns2.ReasonIdleTimeout, 503, "60"},
+		{apns2.ReasonUnregistered, 410, ""},
+		{apns2.ReasonBadDeviceToken, 404, ""},
+		{apns2.ReasonPayloadTooLarge, 413, ""},
+		{apns2.ReasonBadTopic, 502, ""},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		writeFailure(recorder, &apns2.Response{Reason: test.reason})
+
+		if recorder.Code != test.want {
+			t.Errorf("writeFailure(%s) status = %d, want %d", test.reason, recorder.Code, test.want)
+		}
+		if got := recorder.Header().Get("Retry-After"); got != test.retryAfter {
+			t.Errorf("writeFailure(%s) Retry-After = %q, want %q", test.reason, got, test.retryAfter)
+		}
+	}
+}
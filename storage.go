@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// store is a simple key-value store, which the relay's state is kept in. Values are
+// usually JSON encoded.
+type store interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Keys() ([]string, error)
+}
+
+// newStore returns a store that keeps its values in files in the given directory, or
+// in memory if no directory is given.
+func newStore(dir string) store {
+	if dir == "" {
+		return &memoryStore{values: make(map[string][]byte)}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Error creating directory %s: %v\n", dir, err)
+	}
+
+	return &dirStore{dir: dir}
+}
+
+type memoryStore struct {
+	sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *memoryStore) Put(key string, value []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memoryStore) Keys() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// dirStore keeps each value in a file named by its escaped key. Values are written to
+// a temporary file first and then renamed, so that a crash never leaves a partially
+// written value behind.
+type dirStore struct {
+	dir string
+}
+
+const tempPrefix = ".tmp-"
+
+func (s *dirStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key))
+}
+
+func (s *dirStore) Get(key string) ([]byte, bool) {
+	value, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *dirStore) Put(key string, value []byte) error {
+	file, err := ioutil.TempFile(s.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := os.Rename(file.Name(), s.path(key)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// The rename itself is only durable once the directory has been synced.
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *dirStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *dirStore) Keys() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			continue
+		}
+
+		if key, err := url.PathUnescape(info.Name()); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
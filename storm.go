@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ways to handle storms of pushes to a device, as set by STORM_MODE.
+const (
+	stormOff      = "off"
+	stormCoalesce = "coalesce"
+	stormSilent   = "silent"
+)
+
+// storm tracks the alerting notifications sent to a device in the current window, and
+// the messages held back to be sent at its end when coalescing.
+type storm struct {
+	app     *app
+	started time.Time
+	alerts  int
+
+	// suppressed counts the messages beyond the limit in the current window.
+	suppressed int
+
+	// pending holds the latest held back message for each collapse ID, with the number of
+	// messages it stands for.
+	pending map[string]*pendingMessage
+	timer   *time.Timer
+}
+
+type pendingMessage struct {
+	message *message
+	count   int
+}
+
+var (
+	stormsMutex sync.Mutex
+	storms      = make(map[string]*storm)
+)
+
+// startStorms starts forgetting storms that are over, if any app has storm protection.
+func startStorms() {
+	enabled := defaultApp.stormMode != stormOff
+	for _, a := range apps {
+		enabled = enabled || a.stormMode != stormOff
+	}
+
+	if enabled {
+		go func() {
+			for range time.Tick(time.Minute) {
+				expireStorms()
+			}
+		}()
+	}
+}
+
+// admitStorms applies the storm protection of their apps to messages about to be
+// delivered, and returns those to deliver now. Once a device has been sent STORM_LIMIT
+// alerting notifications within STORM_WINDOW, further messages in that window are
+// either held back and only the latest for each collapse ID sent at the end of it, or
+// sent as silent notifications. Both carry the number of messages they stand for in c.
+func admitStorms(messages []*message) []*message {
+	admitted := messages[:0]
+	for _, m := range messages {
+		if admitStorm(m) {
+			admitted = append(admitted, m)
+		}
+	}
+	return admitted
+}
+
+func admitStorm(m *message) bool {
+	a := m.app()
+	if a.stormMode == stormOff {
+		return true
+	}
+
+	key := tombstoneKey(a, m.Environment, m.DeviceToken)
+	now := time.Now()
+
+	stormsMutex.Lock()
+	defer stormsMutex.Unlock()
+
+	s, ok := storms[key]
+	if !ok || (now.Sub(s.started) >= a.stormWindow && len(s.pending) == 0) {
+		s = &storm{app: a, started: now}
+		storms[key] = s
+	}
+
+	if s.alerts < a.stormLimit && len(s.pending) == 0 {
+		s.alerts++
+		return true
+	}
+
+	s.suppressed++
+
+	flush := s.started.Add(a.stormWindow)
+
+	// Messages that would expire before the end of the window cannot be held back, and
+	// are sent as silent notifications instead.
+	if a.stormMode == stormSilent || (!m.Expiration.IsZero() && m.Expiration.Before(flush)) {
+		m.Silent = true
+		m.setCount(s.suppressed)
+		stormMessages.Add("silent", 1)
+		log.Printf("Sending message %s to %s silently, %d in storm\n", m.ID, m.DeviceToken, s.suppressed)
+		return true
+	}
+
+	if s.pending == nil {
+		s.pending = make(map[string]*pendingMessage)
+	}
+
+	count := 1
+	if previous, ok := s.pending[m.CollapseID]; ok {
+		count += previous.count
+		log.Printf("Coalescing message %s to %s into %s\n", previous.message.ID, m.DeviceToken, m.ID)
+	}
+	s.pending[m.CollapseID] = &pendingMessage{message: m, count: count}
+	stormMessages.Add("held", 1)
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(time.Until(flush), func() {
+			flushStorm(key, s)
+		})
+	}
+
+	return false
+}
+
+// flushStorm sends the messages held back during a storm that have not expired, and
+// starts a new window, in which they count as alerts.
+func flushStorm(key string, s *storm) {
+	stormsMutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.timer = nil
+	s.started = time.Now()
+	s.alerts = len(pending)
+	s.suppressed = 0
+	stormsMutex.Unlock()
+
+	for _, p := range pending {
+		m := p.message
+		if !m.Expiration.IsZero() && m.Expiration.Before(time.Now()) {
+			log.Printf("Dropping held back message %s to %s, which expired at %v\n", m.ID, m.DeviceToken, m.Expiration)
+			continue
+		}
+
+		if p.count > 1 {
+			m.setCount(p.count)
+			stormMessages.Add("coalesced", int64(p.count-1))
+		}
+
+		if queue == nil || !enqueue(m) {
+			go deliverWithRetries(context.Background(), m)
+		}
+	}
+}
+
+// setCount sets the number of messages that a message stands for in c. The fields are
+// copied first, as they are shared with the copies of the message for other devices.
+// The count is left out if the payload would become too large.
+func (m *message) setCount(count int) {
+	fields := make(map[string]string, len(m.Fields)+1)
+	for name, value := range m.Fields {
+		fields[name] = value
+	}
+	fields["c"] = strconv.Itoa(count)
+
+	previous := m.Fields
+	m.Fields = fields
+	if payloadSize(m) > maxPayloadSize {
+		m.Fields = previous
+	}
+}
+
+// expireStorms forgets the devices whose windows have ended without anything held back.
+func expireStorms() {
+	stormsMutex.Lock()
+	defer stormsMutex.Unlock()
+
+	now := time.Now()
+	for key, s := range storms {
+		if now.Sub(s.started) >= s.app.stormWindow && len(s.pending) == 0 {
+			delete(storms, key)
+		}
+	}
+}
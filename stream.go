@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// streamKeepAlive is how often a comment is sent on idle streams, so that proxies do
+// not close them.
+const streamKeepAlive = 30 * time.Second
+
+// streamBackend delivers pushes to clients that hold a Server-Sent Events stream open,
+// such as desktop apps. Each client is a target of a registration, with the environment
+// stream and a name of its choosing as the device token. Pushes are kept in a buffer for
+// each client until they expire, so that those that arrive while it is disconnected are
+// sent when it reconnects.
+type streamBackend struct {
+	buffers *mailboxStore
+
+	mutex       sync.Mutex
+	subscribers map[string]map[chan mailboxEntry]bool
+}
+
+var streams *streamBackend
+
+func newStreamBackend(dir string, size int, ttl time.Duration) *streamBackend {
+	return &streamBackend{
+		buffers:     newMailboxStore(dir, size, ttl),
+		subscribers: make(map[string]map[chan mailboxEntry]bool),
+	}
+}
+
+// errStreamNotRegistered rejects pushes to streams through endpoints other than
+// registered ones, as only the clients of registrations can connect to streams.
+var errStreamNotRegistered = errors.New("Streams can only be pushed to through registered endpoints")
+
+func streamKey(registration, name string) string {
+	return registration + "/" + name
+}
+
+// push keeps a message in the buffer of the client, and sends it to the client if it is
+// connected. It is sent in the same form as in a mailbox.
+func (s *streamBackend) push(m *message) (*apns2.Response, error) {
+	// Only clients of registrations can connect, so there is nobody to stream to
+	// otherwise.
+	if m.Registration == "" {
+		log.Printf("Not streaming message %s to %s, which is not registered\n", m.ID, m.DeviceToken)
+		return &apns2.Response{StatusCode: 400, Reason: apns2.ReasonMissingDeviceToken, ApnsID: m.ID}, nil
+	}
+
+	fields, err := m.wholeFields()
+	if err != nil {
+		return nil, err
+	}
+
+	c := *m
+	c.Fields = fields
+
+	key := streamKey(m.Registration, m.DeviceToken)
+	entry, ok := s.buffers.Put(key, &c)
+	if !ok {
+		log.Printf("Not streaming message %s to %s, which has expired\n", m.ID, key)
+		return &apns2.Response{StatusCode: 200, ApnsID: m.ID}, nil
+	}
+
+	s.mutex.Lock()
+	sent := 0
+	for events := range s.subscribers[key] {
+		select {
+		case events <- entry:
+			sent++
+		default:
+			// The client is not keeping up, so it is disconnected, and gets the message
+			// from the buffer when it reconnects.
+			delete(s.subscribers[key], events)
+			close(events)
+		}
+	}
+	s.mutex.Unlock()
+
+	pushAttempts.Add("sent", 1)
+	log.Printf("Streamed message %s to %d connections of %s\n", m.ID, sent, key)
+
+	return &apns2.Response{StatusCode: 200, ApnsID: m.ID}, nil
+}
+
+func (s *streamBackend) subscribe(key string) chan mailboxEntry {
+	events := make(chan mailboxEntry, 16)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.subscribers[key] == nil {
+		s.subscribers[key] = make(map[chan mailboxEntry]bool)
+	}
+	s.subscribers[key][events] = true
+
+	return events
+}
+
+func (s *streamBackend) unsubscribe(key string, events chan mailboxEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.subscribers[key][events] {
+		delete(s.subscribers[key], events)
+		close(events)
+	}
+
+	if len(s.subscribers[key]) == 0 {
+		delete(s.subscribers, key)
+	}
+}
+
+// streamHandler serves GET /stream/<id>/<name>, which streams the pushes to the client
+// with that name in the registration with the ID as Server-Sent Events, starting with
+// those buffered after the cursor given as Last-Event-ID, or as the since query
+// parameter. It must be authorized with the secret of the registration, as a bearer
+// token.
+func streamHandler(writer http.ResponseWriter, request *http.Request) {
+	components := strings.Split(strings.TrimPrefix(request.URL.Path, "/stream/"), "/")
+	if len(components) != 2 || components[1] == "" {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Invalid URL path:", request.URL.Path)
+		return
+	}
+
+	reg, ok := registry.Get(components[0])
+	if !ok {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Unknown subscription:", components[0])
+		return
+	}
+
+	if !authorizeRegistration(writer, request, reg) {
+		return
+	}
+
+	found := false
+	for _, t := range reg.Targets {
+		found = found || (t.Environment == environmentStream && t.DeviceToken == components[1])
+	}
+	if !found {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, "Unknown stream:", components[1])
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(500)
+		fmt.Fprintln(writer, "Streaming is not supported")
+		return
+	}
+
+	since := request.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = request.URL.Query().Get("since")
+	}
+
+	var cursor int64
+	if since != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(since, 10, 64); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Invalid cursor:", since)
+			return
+		}
+	}
+
+	key := streamKey(reg.ID, components[1])
+
+	// Subscribe before sending the buffered messages, so that none are missed in
+	// between. Those that are both buffered and sent live are only sent once, as
+	// messages at or before the cursor are skipped.
+	events := streams.subscribe(key)
+	defer streams.unsubscribe(key, events)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(200)
+	flusher.Flush()
+
+	log.Printf("Opened stream %s from %v\n", key, clientIP(request))
+
+	send := func(entry mailboxEntry) bool {
+		if entry.Cursor <= cursor {
+			return true
+		}
+
+		data, _ := json.Marshal(entry)
+		if _, err := fmt.Fprintf(writer, "id: %d\nevent: push\ndata: %s\n\n", entry.Cursor, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+
+		cursor = entry.Cursor
+		return true
+	}
+
+	for more := true; more; {
+		var entries []mailboxEntry
+		entries, more = streams.buffers.Since(key, cursor, maxMailboxPage)
+		for _, entry := range entries {
+			if !send(entry) {
+				return
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case entry, ok := <-events:
+			if !ok || !send(entry) {
+				log.Println("Closed stream", key)
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			log.Println("Closed stream", key)
+			return
+		}
+	}
+}
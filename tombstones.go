@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// tombstone records that APNs has reported a device token as no longer valid, so that
+// later pushes to it can be rejected without asking APNs again.
+type tombstone struct {
+	Reason string `json:"reason"`
+
+	// Timestamp is the last time APNs confirmed that the token was no longer valid, if
+	// it said. Recorded is when the tombstone was created, which retention counts from.
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Recorded  time.Time `json:"recorded"`
+}
+
+// tombstoneStore keeps tombstones for device tokens, keyed by app, environment and
+// device token, for the configured retention time, and up to a limit.
+type tombstoneStore struct {
+	store     store
+	retention time.Duration
+	limit     int
+}
+
+var tombstones *tombstoneStore
+
+func newTombstoneStore(dir string, retention time.Duration, limit int) *tombstoneStore {
+	t := &tombstoneStore{
+		store:     newStore(dir),
+		retention: retention,
+		limit:     limit,
+	}
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			t.expire()
+		}
+	}()
+
+	return t
+}
+
+func tombstoneKey(a *app, environment, deviceToken string) string {
+	return a.name + "/" + environment + "/" + deviceToken
+}
+
+// Get returns the tombstone for a device token, if there is one that has not expired.
+func (t *tombstoneStore) Get(key string) (*tombstone, bool) {
+	if t.retention <= 0 {
+		return nil, false
+	}
+
+	value, ok := t.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	var stone tombstone
+	if err := json.Unmarshal(value, &stone); err != nil {
+		log.Println("Error reading tombstone:", err)
+		return nil, false
+	}
+
+	if time.Since(stone.Recorded) > t.retention {
+		t.store.Delete(key)
+		return nil, false
+	}
+
+	return &stone, true
+}
+
+func (t *tombstoneStore) Put(key, reason string, timestamp time.Time) {
+	if t.retention <= 0 {
+		return
+	}
+
+	if _, exists := t.store.Get(key); !exists {
+		if keys, err := t.store.Keys(); err == nil && len(keys) >= t.limit {
+			log.Printf("Tombstones full, not recording %s\n", key)
+			return
+		}
+	}
+
+	value, _ := json.Marshal(&tombstone{
+		Reason:    reason,
+		Timestamp: timestamp,
+		Recorded:  time.Now(),
+	})
+
+	if err := t.store.Put(key, value); err != nil {
+		log.Println("Error storing tombstone:", err)
+	}
+}
+
+// Delete removes the tombstone for a device token, for instance if it has become valid
+// again. It returns whether there was a tombstone.
+func (t *tombstoneStore) Delete(key string) bool {
+	_, existed := t.store.Get(key)
+	if err := t.store.Delete(key); err != nil {
+		log.Println("Error deleting tombstone:", err)
+	}
+	return existed
+}
+
+func (t *tombstoneStore) expire() {
+	keys, err := t.store.Keys()
+	if err != nil {
+		log.Println("Error listing tombstones:", err)
+		return
+	}
+
+	// Get deletes the tombstones that have expired.
+	for _, key := range keys {
+		t.Get(key)
+	}
+}
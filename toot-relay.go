@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
@@ -9,6 +11,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -16,20 +19,15 @@ import (
 	"time"
 
 	"github.com/sideshow/apns2"
-	"github.com/sideshow/apns2/certificate"
-	"github.com/sideshow/apns2/payload"
 	"golang.org/x/net/http2"
 )
 
-var (
-	developmentClient *apns2.Client
-	productionClient  *apns2.Client
-)
-
 func main() {
-	p12file := env("P12_FILENAME", "toot-relay.p12")
-	p12base64 := env("P12_BASE64", "")
-	p12password := env("P12_PASSWORD", "")
+	if len(os.Args) > 1 && os.Args[1] == "mint" {
+		loadSealingConfiguration()
+		mintCommand(os.Args[2:])
+		return
+	}
 
 	port := env("PORT", "42069")
 	tlsCrtFile := env("CRT_FILENAME", "toot-relay.crt")
@@ -38,8 +36,82 @@ func main() {
 	// used as the sole root CAs when connecting to the Apple Notification Service API.
 	// If unset, the system-wide certificate store will be used.
 	caFile := env("CA_FILENAME", "")
+	// VAPID_MODE selects whether the VAPID authorization of incoming pushes is checked.
+	// "off" ignores it, "log" logs failures but delivers anyway, and "enforce" rejects
+	// pushes that fail verification. PUBLIC_URL is the origin that tokens must name as
+	// their audience. If unset, it is derived from each request.
+	vapidMode = env("VAPID_MODE", vapidOff)
+	publicURL = env("PUBLIC_URL", "")
+	// Device tokens that APNs reports as no longer valid are remembered for
+	// TOMBSTONE_RETENTION, up to TOMBSTONE_LIMIT of them, in memory or in files in
+	// TOMBSTONE_DIR, and pushes to them are rejected without asking APNs. ADMIN_TOKEN
+	// enables the admin endpoints.
+	tombstoneDir := env("TOMBSTONE_DIR", "")
+	tombstoneRetention := envDuration("TOMBSTONE_RETENTION", 30*24*time.Hour)
+	tombstoneLimit := envInt("TOMBSTONE_LIMIT", 100000)
+	adminToken = env("ADMIN_TOKEN", "")
+	// Bodies too large for APNs are kept for at most OFFLOAD_TTL, in memory or in files in
+	// OFFLOAD_DIR, for the client to fetch.
+	offloadDir := env("OFFLOAD_DIR", "")
+	offloadTTL := envDuration("OFFLOAD_TTL", 48*time.Hour)
+	// Push bodies larger than MAX_BODY_SIZE are rejected.
+	maxBodySize = int64(envInt("MAX_BODY_SIZE", int(maxBodySize)))
+	// Pushes that could not be delivered are kept, up to DEAD_LETTER_LIMIT, in memory or
+	// in files in DEAD_LETTER_DIR, so that they can be replayed by the admin endpoints.
+	deadLetterDir := env("DEAD_LETTER_DIR", "")
+	deadLetterLimit := envInt("DEAD_LETTER_LIMIT", 1000)
+	// With WORKERS set, pushes are accepted as soon as they are queued, and delivered to
+	// APNs by that many workers. Pushes are rejected while QUEUE_SIZE are waiting. With
+	// QUEUE_DIR set, queued pushes are also written there until delivered, and those
+	// that have not expired are delivered after a restart.
+	workers := envInt("WORKERS", 0)
+	queueSize := envInt("QUEUE_SIZE", 1000)
+	queueDir := env("QUEUE_DIR", "")
+	// Transient failures are retried up to RETRY_ATTEMPTS times in all, with a delay that
+	// starts at RETRY_BASE_DELAY and doubles for each attempt up to RETRY_MAX_DELAY.
+	retryAttempts = envInt("RETRY_ATTEMPTS", retryAttempts)
+	retryBaseDelay = envDuration("RETRY_BASE_DELAY", retryBaseDelay)
+	retryMaxDelay = envDuration("RETRY_MAX_DELAY", retryMaxDelay)
+	retrySyncLimit = envDuration("RETRY_SYNC_LIMIT", retrySyncLimit)
+	// ENDPOINT_KEYS holds the keys that sealed endpoints are encrypted with. With
+	// RAW_ENDPOINTS set to false, only sealed endpoints are accepted. With
+	// ENDPOINT_SECRETS set, raw endpoints must be signed with one of them. MINT_TOKEN
+	// enables minting endpoints over HTTP, for those who know it.
+	rawEndpoints = env("RAW_ENDPOINTS", "true") != "false"
+	mintToken = env("MINT_TOKEN", "")
+	// With REGISTRY_DIR set, apps can register device tokens, which are kept in files in
+	// that directory, and get stable endpoints for them. REGISTRY_TOKEN is required to
+	// register.
+	registryDir := env("REGISTRY_DIR", "")
+	registryToken = env("REGISTRY_TOKEN", "")
+	// With MAILBOX_SIZE set, registrations can opt in to keeping that many of their most
+	// recent pushes, for at most MAILBOX_TTL, in memory or in files in MAILBOX_DIR.
+	mailboxSize := envInt("MAILBOX_SIZE", 0)
+	mailboxDir := env("MAILBOX_DIR", "")
+	mailboxTTL := envDuration("MAILBOX_TTL", 48*time.Hour)
+	// With STREAM_BUFFER_SIZE set, registrations can have clients that receive pushes on
+	// streams, which keep that many pushes for each client that is disconnected, for at
+	// most STREAM_TTL, in memory or in files in STREAM_DIR.
+	streamBufferSize := envInt("STREAM_BUFFER_SIZE", 0)
+	streamDir := env("STREAM_DIR", "")
+	streamTTL := envDuration("STREAM_TTL", 48*time.Hour)
+	// RATE_LIMIT_IP, RATE_LIMIT_VAPID and RATE_LIMIT_TOKEN limit pushes by client address,
+	// VAPID key and device token. DENY_IPS and DENY_VAPID_KEYS reject pushes outright.
+	loadAbuseControls()
+	// TRUSTED_PROXIES are the networks of proxies whose X-Forwarded-For and Forwarded
+	// headers give the client address. With PROXY_PROTOCOL set to true, connections must
+	// start with a PROXY protocol header, if they come from a trusted proxy.
+	loadProxyConfiguration()
+	proxyProtocol := env("PROXY_PROTOCOL", "false") == "true"
+	loadSealingConfiguration()
 	var rootCAs *x509.CertPool
 
+	switch vapidMode {
+	case vapidOff, vapidLog, vapidEnforce:
+	default:
+		log.Fatalf("Unknown VAPID_MODE %s\n", vapidMode)
+	}
+
 	if caPEM, err := ioutil.ReadFile(caFile); err == nil {
 		rootCAs = x509.NewCertPool()
 		if ok := rootCAs.AppendCertsFromPEM(caPEM); !ok {
@@ -47,90 +119,285 @@ func main() {
 		}
 	}
 
-	if p12base64 != "" {
-		bytes, err := base64.StdEncoding.DecodeString(p12base64)
-		if err != nil {
-			log.Fatal("Base64 decoding error: ", err)
+	loadApps(rootCAs)
+	loadFCM()
+	loadUnifiedPush()
+	loadWebhook()
+	startStorms()
+
+	tombstones = newTombstoneStore(tombstoneDir, tombstoneRetention, tombstoneLimit)
+	deadLetters = newDeadLetterStore(deadLetterDir, deadLetterLimit)
+	blobs = newBlobStore(offloadDir, offloadTTL)
+
+	if workers > 0 {
+		startWorkers(workers, queueSize, queueDir)
+	} else if queueDir != "" {
+		log.Fatal("QUEUE_DIR requires WORKERS to be set")
+	}
+
+	// The default mux is not used, as importing expvar serves its metrics there without
+	// authorization.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/relay-to/", handler)
+	mux.HandleFunc("/blob/", blobHandler)
+
+	if len(sealingKeys) > 0 {
+		mux.HandleFunc("/sealed/", handler)
+	} else if !rawEndpoints {
+		log.Fatal("RAW_ENDPOINTS can only be disabled if ENDPOINT_KEYS is set")
+	}
+
+	if registryDir != "" {
+		if registryToken == "" {
+			log.Fatal("REGISTRY_DIR requires REGISTRY_TOKEN to be set")
 		}
 
-		cert, err := certificate.FromP12Bytes(bytes, p12password)
-		if err != nil {
-			log.Fatal("Error parsing certificate: ", err)
+		registry = newRegistryStore(newStore(registryDir))
+		mux.HandleFunc("/push/", handler)
+		mux.HandleFunc("/subscriptions", registryHandler)
+		mux.HandleFunc("/subscriptions/", registryHandler)
+
+		if mailboxSize > 0 {
+			mailboxes = newMailboxStore(mailboxDir, mailboxSize, mailboxTTL)
+			mux.HandleFunc("/mailbox/", mailboxHandler)
 		}
 
-		developmentClient = apns2.NewClient(cert).Development()
-		productionClient = apns2.NewClient(cert).Production()
-	} else {
-		cert, err := certificate.FromP12File(p12file, p12password)
-		if err != nil {
-			log.Fatal("Error loading certificate file: ", err)
+		if streamBufferSize > 0 {
+			streams = newStreamBackend(streamDir, streamBufferSize, streamTTL)
+			backends[environmentStream] = streams
+			mux.HandleFunc("/stream/", streamHandler)
 		}
+	} else if mailboxSize > 0 || streamBufferSize > 0 {
+		log.Fatal("MAILBOX_SIZE and STREAM_BUFFER_SIZE require REGISTRY_DIR to be set")
+	}
+
+	if mintToken != "" && (len(sealingKeys) > 0 || len(endpointSecrets) > 0) {
+		mux.HandleFunc("/endpoints", mintHandler)
+	}
+
+	if adminToken != "" {
+		mux.HandleFunc("/admin/tombstones/", tombstonesHandler)
+		mux.HandleFunc("/admin/dead-letters", deadLettersHandler)
+		mux.HandleFunc("/admin/dead-letters/", deadLettersHandler)
+		mux.HandleFunc("/admin/metrics", metricsHandler)
+	}
 
-		developmentClient = apns2.NewClient(cert).Development()
-		productionClient = apns2.NewClient(cert).Production()
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if rootCAs != nil {
-		developmentClient.HTTPClient.Transport.(*http2.Transport).TLSClientConfig.RootCAs = rootCAs
-		productionClient.HTTPClient.Transport.(*http2.Transport).TLSClientConfig.RootCAs = rootCAs
+	if proxyProtocol {
+		listener = &proxyListener{Listener: listener}
 	}
 
-	http.HandleFunc("/relay-to/", handler)
+	server := &http.Server{Handler: mux}
 
 	if _, err := os.Stat("toot-relay.crt"); !os.IsNotExist(err) {
-		log.Fatal(http.ListenAndServeTLS(":"+port, tlsCrtFile, tlsKeyFile, nil))
+		log.Fatal(server.ServeTLS(listener, tlsCrtFile, tlsKeyFile))
 	} else {
-		log.Fatal(http.ListenAndServe(":"+port, nil))
+		log.Fatal(server.Serve(listener))
 	}
 }
 
 func handler(writer http.ResponseWriter, request *http.Request) {
-	components := strings.Split(request.URL.Path, "/")
+	ip := clientIP(request)
+	if deniedIP(ip) {
+		denied.Add("ip", 1)
+		writer.WriteHeader(403)
+		fmt.Fprintln(writer, "Forbidden")
+		log.Println("Denied push from", ip)
+		return
+	}
 
-	if len(components) < 4 {
-		writer.WriteHeader(500)
-		fmt.Fprintln(writer, "Invalid URL path:", request.URL.Path)
-		log.Println("Invalid URL path:", request.URL.Path)
+	if ok, wait := ipLimiter.allow(ip.String()); !ok {
+		writeRateLimited(writer, "ip", ip.String(), wait)
 		return
 	}
 
-	isProduction := components[2] == "production"
+	endpoint, err := parseEndpoint(request)
+	if err != nil {
+		writer.WriteHeader(404)
+		fmt.Fprintln(writer, err)
+		log.Println(err, "from", ip)
+		return
+	}
 
-	notification := &apns2.Notification{}
-	notification.DeviceToken = components[3]
+	for _, t := range endpoint.recipients() {
+		if !t.valid() {
+			writer.WriteHeader(404)
+			fmt.Fprintln(writer, "Invalid device token:", t.DeviceToken)
+			log.Println("Invalid device token", t.DeviceToken, "from", ip)
+			return
+		}
+	}
+
+	if len(endpointSecrets) > 0 && !endpoint.opaque {
+		if err := verifyTag(endpoint); err != nil {
+			writer.WriteHeader(403)
+			fmt.Fprintln(writer, err)
+			log.Println(err, request.URL.Path, "from", ip)
+			return
+		}
+	}
+
+	// Endpoints bound to an application server key always require a valid VAPID
+	// authorization by that key, regardless of VAPID_MODE. The key is also needed for
+	// the rate limits and deny-list of VAPID keys, which only apply to verified keys, as
+	// anyone could claim any other key.
+	if endpoint.serverKey != "" || vapidMode != vapidOff || vapidLimiter != nil || len(deniedKeys) > 0 {
+		key, err := verifyVAPID(request)
+		if err == nil && endpoint.serverKey != "" && key != endpoint.serverKey {
+			err = &vapidError{status: 403, message: "VAPID key does not match the key of the subscription"}
+		}
+
+		if err != nil {
+			if vapidMode == vapidEnforce || endpoint.serverKey != "" {
+				writer.Header().Set("WWW-Authenticate", "vapid")
+				writer.WriteHeader(err.(*vapidError).status)
+				fmt.Fprintln(writer, "VAPID verification failed:", err)
+				log.Println("VAPID verification failed:", err, "from", ip)
+				return
+			}
+
+			if vapidMode == vapidLog {
+				log.Println("VAPID verification failed (not enforced):", err, "from", ip)
+			}
+		} else {
+			if deniedKeys[key] {
+				denied.Add("vapid", 1)
+				writer.WriteHeader(403)
+				fmt.Fprintln(writer, "Forbidden")
+				log.Println("Denied push signed by", key, "from", ip)
+				return
+			}
+
+			if ok, wait := vapidLimiter.allow(key); !ok {
+				writeRateLimited(writer, "vapid", key, wait)
+				return
+			}
+		}
+	}
+
+	// Devices that are known to be gone are skipped, and removed from registrations unless
+	// they are the last. The endpoint is only gone once all of its devices are. Devices that have had too many
+	// pushes are also skipped, and the push is only rejected if all of them have, as are
+	// devices whose backend is not configured.
+	var targets []target
+	var stone *tombstone
+	var limited, unavailable []string
+	var wait time.Duration
+	for _, t := range endpoint.recipients() {
+		if _, ok := backendFor(t.Environment); !ok {
+			log.Println("No backend configured for", t.Environment)
+			unavailable = append(unavailable, t.Environment)
+			continue
+		}
+
+		key := tombstoneKey(endpoint.app, t.Environment, t.DeviceToken)
+		if s, ok := tombstones.Get(key); ok {
+			log.Printf("Not sending to %s, which was found to be %s at %v\n", t.DeviceToken, s.Reason, s.Recorded)
+			if endpoint.registration != "" {
+				registry.prune(endpoint.registration, t.DeviceToken)
+			}
+			stone = s
+			continue
+		}
+
+		if ok, w := tokenLimiter.allow(key); !ok {
+			if limited == nil || w < wait {
+				wait = w
+			}
+			limited = append(limited, t.DeviceToken)
+			continue
+		}
+
+		targets = append(targets, t)
+	}
+
+	if len(targets) == 0 && limited != nil {
+		writeRateLimited(writer, "token", strings.Join(limited, ", "), wait)
+		return
+	}
+
+	if len(targets) == 0 && unavailable != nil {
+		writer.WriteHeader(502)
+		fmt.Fprintln(writer, "No backend configured for", strings.Join(unavailable, ", "))
+		return
+	}
+
+	// A registration outlives its devices, as the app registers new ones after being
+	// reinstalled or restored, so senders are not told that its endpoint is gone.
+	if len(targets) == 0 && endpoint.registration != "" {
+		writer.WriteHeader(202)
+		fmt.Fprintln(writer, "No devices to deliver to")
+		return
+	}
+
+	if len(targets) == 0 {
+		writer.WriteHeader(410)
+		fmt.Fprintln(writer, stone.Reason)
+		return
+	}
 
 	buffer := new(bytes.Buffer)
-	buffer.ReadFrom(request.Body)
-	encodedString := encode85(buffer.Bytes())
-	payload := payload.NewPayload().Alert("🎺").MutableContent().ContentAvailable().Custom("p", encodedString)
+	if _, err := buffer.ReadFrom(http.MaxBytesReader(writer, request.Body, maxBodySize)); err != nil {
+		if int64(buffer.Len()) >= maxBodySize {
+			writer.WriteHeader(413)
+			fmt.Fprintf(writer, "Body larger than %d bytes\n", maxBodySize)
+			return
+		}
+
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Error reading body:", err)
+		return
+	}
 
-	if len(components) > 4 {
-		payload.Custom("x", strings.Join(components[4:], "/"))
+	m := &message{
+		ID:           newMessageID(),
+		App:          endpoint.app.name,
+		Registration: endpoint.registration,
+		Fields:       map[string]string{"p": encode85(buffer.Bytes())},
+		Headers:      request.Header.Clone(),
+		Received:     time.Now(),
 	}
+	m.Headers.Del("Authorization")
 
-	notification.Payload = payload
-	notification.Topic = "cx.c3.toot"
+	if endpoint.extra != "" {
+		m.Fields["x"] = endpoint.extra
+	}
 
 	switch request.Header.Get("Content-Encoding") {
 	case "aesgcm":
 		if publicKey, err := encodedValue(request.Header, "Crypto-Key", "dh"); err == nil {
-			payload.Custom("k", publicKey)
+			m.Fields["k"] = publicKey
 		} else {
-			writer.WriteHeader(500)
+			writer.WriteHeader(400)
 			fmt.Fprintln(writer, "Error retrieving public key:", err)
 			log.Println("Error retrieving public key:", err)
 			return
 		}
 
 		if salt, err := encodedValue(request.Header, "Encryption", "salt"); err == nil {
-			payload.Custom("s", salt)
+			m.Fields["s"] = salt
 		} else {
-			writer.WriteHeader(500)
+			writer.WriteHeader(400)
 			fmt.Fprintln(writer, "Error retrieving salt:", err)
 			log.Println("Error retrieving salt:", err)
 			return
 		}
-	//case "aes128gcm": // No further headers needed. However, not implemented on client side so return 415.
+	case "aes128gcm":
+		// All parameters needed for decryption are in the record header at the start of
+		// the body, so no further headers are needed. The client is told which scheme
+		// to use, as it otherwise assumes aesgcm.
+		if err := checkRecordHeader(buffer.Bytes()); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Invalid aes128gcm body:", err)
+			log.Println("Invalid aes128gcm body:", err)
+			return
+		}
+
+		m.Fields["e"] = "aes128gcm"
 	default:
 		writer.WriteHeader(415)
 		fmt.Fprintln(writer, "Unsupported Content-Encoding:", request.Header.Get("Content-Encoding"))
@@ -139,49 +406,137 @@ func handler(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	if seconds := request.Header.Get("TTL"); seconds != "" {
-		if ttl, err := strconv.Atoi(seconds); err == nil {
-			notification.Expiration = time.Now().Add(time.Duration(ttl) * time.Second)
+		ttl, err := strconv.Atoi(seconds)
+		if err != nil || ttl < 0 {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Invalid TTL:", seconds)
+			log.Println("Invalid TTL:", seconds)
+			return
 		}
+
+		m.Expiration = m.Received.Add(time.Duration(ttl) * time.Second)
 	}
 
 	if topic := request.Header.Get("Topic"); topic != "" {
-		notification.CollapseID = topic
+		m.CollapseID = topic
 	}
 
 	switch request.Header.Get("Urgency") {
 	case "very-low", "low":
-		notification.Priority = apns2.PriorityLow
+		m.Priority = apns2.PriorityLow
 	default:
-		notification.Priority = apns2.PriorityHigh
+		m.Priority = apns2.PriorityHigh
 	}
 
-	var client *apns2.Client
-	if isProduction {
-		client = productionClient
-	} else {
-		client = developmentClient
+	if endpoint.mailbox {
+		mailboxes.Put(endpoint.registration, m)
+	}
+
+	oversized := payloadSize(m) > maxPayloadSize
+	if oversized && endpoint.app.oversize == oversizeSplit {
+		if err := split(m); err != nil {
+			writer.WriteHeader(413)
+			fmt.Fprintln(writer, "Error splitting payload:", err)
+			log.Println("Error splitting payload:", err)
+			return
+		}
+	}
+
+	messages := m.forTargets(targets)
+
+	// Offloaded bodies can only be fetched once, so each device gets its own.
+	for _, c := range messages {
+		if !oversized || endpoint.app.oversize != oversizeOffload || !offloadsBodies(c.Environment) {
+			continue
+		}
+
+		// The URL the device fetches the body from must not come from the request, or
+		// a sender could point devices at a server of its choosing.
+		if publicURL == "" {
+			writer.WriteHeader(413)
+			fmt.Fprintln(writer, "Payload too large, and PUBLIC_URL is not set to offload it")
+			log.Println("Not offloading payload, as PUBLIC_URL is not set")
+			return
+		}
+
+		if err := blobs.offload(c, buffer.Bytes(), strings.TrimRight(publicURL, "/")); err != nil {
+			writer.WriteHeader(500)
+			fmt.Fprintln(writer, "Error offloading payload:", err)
+			log.Println("Error offloading payload:", err)
+			return
+		}
+	}
+
+	messages = admitStorms(messages)
+	if len(messages) == 0 {
+		// The push was held back for all devices, to be sent at the end of a storm.
+		writer.Header().Add("Location", fmt.Sprintf("https://not-supported/%v", m.ID))
+		writer.WriteHeader(201)
+		return
+	}
+
+	if queue != nil {
+		// The push is accepted if it could be queued for any of the devices.
+		var accepted *message
+		for _, m := range messages {
+			if enqueue(m) {
+				if accepted == nil {
+					accepted = m
+				}
+			} else {
+				log.Println("Queue full, rejecting notification to", m.DeviceToken)
+			}
+		}
+
+		if accepted == nil {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+			writer.WriteHeader(503)
+			fmt.Fprintln(writer, "Queue full")
+			return
+		}
+
+		writer.Header().Add("Location", fmt.Sprintf("https://not-supported/%v", accepted.ID))
+		writer.WriteHeader(201)
+		return
 	}
 
-	res, err := client.Push(notification)
+	// Without a queue, the sender waits for the retries, so they may only take as long
+	// as it can be expected to wait.
+	ctx, cancel := context.WithTimeout(request.Context(), retrySyncLimit)
+	defer cancel()
+
+	var res *apns2.Response
+	if len(messages) == 1 {
+		res, err = deliverWithRetries(ctx, messages[0])
+	} else {
+		res, err = fanOut(ctx, messages)
+	}
 	if err != nil {
-		writer.WriteHeader(500)
+		writer.WriteHeader(502)
 		fmt.Fprintln(writer, "Push error:", err)
-		log.Println("Push error:", err)
 		return
 	}
 
-	if res.Sent() {
+	switch {
+	case res.Sent():
 		writer.Header().Add("Location", fmt.Sprintf("https://not-supported/%v", res.ApnsID))
 		writer.WriteHeader(201)
-		log.Printf("Sent notification to %s -> %v %v %v", notification.DeviceToken, res.StatusCode, res.ApnsID, res.Reason)
-		log.Println("Expiration:", notification.Expiration)
-		log.Println("Priority:", notification.Priority)
-		log.Println("CollapseID:", notification.CollapseID)
-	} else {
-		writer.WriteHeader(res.StatusCode)
+	case endpoint.registration != "" && (webPushStatus(res) == 404 || webPushStatus(res) == 410):
+		// As above, the devices of a registration being gone does not make it gone.
+		writer.WriteHeader(202)
 		fmt.Fprintln(writer, res.Reason)
-		log.Printf("Failed to send: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+	default:
+		writeFailure(writer, res)
+		fmt.Fprintln(writer, res.Reason)
+	}
+}
+
+func setRootCAs(client *apns2.Client, rootCAs *x509.CertPool) {
+	transport := client.HTTPClient.Transport.(*http2.Transport)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
 	}
+	transport.TLSClientConfig.RootCAs = rootCAs
 }
 
 func env(name, defaultValue string) string {
@@ -192,6 +547,34 @@ func env(name, defaultValue string) string {
 	}
 }
 
+func envInt(name string, defaultValue int) int {
+	value, isPresent := os.LookupEnv(name)
+	if !isPresent {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid number %s for %s: %v\n", value, name, err)
+	}
+
+	return number
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value, isPresent := os.LookupEnv(name)
+	if !isPresent {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration %s for %s: %v\n", value, name, err)
+	}
+
+	return duration
+}
+
 func encodedValue(header http.Header, name, key string) (string, error) {
 	keyValues := parseKeyValues(header.Get(name))
 	value, exists := keyValues[key]
@@ -209,20 +592,70 @@ func encodedValue(header http.Header, name, key string) (string, error) {
 
 func parseKeyValues(values string) map[string]string {
 	f := func(c rune) bool {
-		return c == ';'
+		return c == ';' || c == ','
 	}
 
 	entries := strings.FieldsFunc(values, f)
 
 	m := make(map[string]string)
 	for _, entry := range entries {
-		parts := strings.Split(entry, "=")
-		m[parts[0]] = parts[1]
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		m[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), "\"")
 	}
 
 	return m
 }
 
+// checkRecordHeader checks the header of an aes128gcm encrypted body as described in
+// RFC 8188 section 2.1, with the additional restrictions from RFC 8291 section 4: the
+// key ID must be the sender's uncompressed P-256 public key, and the body must consist
+// of a single record.
+func checkRecordHeader(body []byte) error {
+	const saltLength = 16
+	const headerLength = saltLength + 4 + 1
+	const keyLength = 65
+	const minRecordSize = 18
+
+	if len(body) < headerLength {
+		return errors.New("Body too short for record header")
+	}
+
+	recordSize := binary.BigEndian.Uint32(body[saltLength:])
+	keyIDLength := int(body[saltLength+4])
+
+	if recordSize < minRecordSize {
+		return errors.New(fmt.Sprintf("Record size %d too small", recordSize))
+	}
+
+	if keyIDLength != keyLength {
+		return errors.New(fmt.Sprintf("Key ID length %d is not that of a P-256 public key", keyIDLength))
+	}
+
+	if len(body) < headerLength+keyIDLength {
+		return errors.New("Body too short for key ID")
+	}
+
+	if body[headerLength] != 0x04 {
+		return errors.New("Key ID is not an uncompressed P-256 public key")
+	}
+
+	// The record consists of the ciphertext plus a 16 byte authentication tag, and
+	// has to contain at least one byte of padding delimiter.
+	recordLength := len(body) - headerLength - keyIDLength
+	if recordLength < 17 {
+		return errors.New("Body too short for encrypted record")
+	}
+
+	if uint64(recordLength) > uint64(recordSize) {
+		return errors.New(fmt.Sprintf("Body of %d bytes does not fit in a single record of size %d", recordLength, recordSize))
+	}
+
+	return nil
+}
+
 var z85digits = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#")
 
 func encode85(bytes []byte) string {
@@ -266,3 +699,49 @@ func encode85(bytes []byte) string {
 
 	return string(encodedBytes)
 }
+
+// decode85 reverses encode85.
+func decode85(encoded string) ([]byte, error) {
+	var values [256]int
+	for i := range values {
+		values[i] = -1
+	}
+	for i, digit := range z85digits {
+		values[digit] = i
+	}
+
+	numBlocks := len(encoded) / 5
+	suffixLength := len(encoded) % 5
+	if suffixLength == 1 {
+		return nil, errors.New("Invalid length of Z85 encoded data")
+	}
+
+	decoded := make([]byte, 0, numBlocks*4+suffixLength)
+
+	for start := 0; start < len(encoded); start += 5 {
+		end := start + 5
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+
+		value := uint64(0)
+		for i := start; i < end; i++ {
+			digit := values[encoded[i]]
+			if digit < 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid Z85 digit %q", encoded[i]))
+			}
+			value = value*85 + uint64(digit)
+		}
+
+		length := end - start - 1
+		if value >= 1<<(8*uint(length)) {
+			return nil, errors.New("Invalid Z85 encoded data")
+		}
+
+		for i := length - 1; i >= 0; i-- {
+			decoded = append(decoded, byte(value>>(8*uint(i))))
+		}
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// recordBody returns an aes128gcm body with the given record size, key ID and record
+// length.
+func recordBody(recordSize uint32, keyID []byte, recordLength int) []byte {
+	body := make([]byte, 16, 16+4+1+len(keyID)+recordLength)
+	body = append(body, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(body[16:], recordSize)
+	body = append(body, byte(len(keyID)))
+	body = append(body, keyID...)
+	return append(body, make([]byte, recordLength)...)
+}
+
+func TestCheckRecordHeader(t *testing.T) {
+	key := append([]byte{0x04}, make([]byte, 64)...)
+	compressed := append([]byte{0x02}, make([]byte, 64)...)
+
+	tests := []struct {
+		name  string
+		body  []byte
+		valid bool
+	}{
+		{"single record", recordBody(4096, key, 100), true},
+		{"record filling the record size", recordBody(117, key, 117), true},
+		{"smallest record", recordBody(18, key, 17), true},
+		{"empty body", nil, false},
+		{"truncated header", recordBody(4096, key, 100)[:20], false},
+		{"record size too small", recordBody(17, key, 17), false},
+		{"short key ID", recordBody(4096, key[:33], 100), false},
+		{"no key ID", recordBody(4096, nil, 100), false},
+		{"truncated key ID", recordBody(4096, key, 0)[:50], false},
+		{"compressed key", recordBody(4096, compressed, 100), false},
+		{"record too short", recordBody(4096, key, 16), false},
+		{"several records", recordBody(100, key, 101), false},
+	}
+
+	for _, test := range tests {
+		err := checkRecordHeader(test.body)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// Protocols that the UnifiedPush backend can forward pushes with, as set by
+// UNIFIEDPUSH_PROTOCOL.
+const (
+	unifiedPushWebPush = "webpush"
+	unifiedPushNtfy    = "ntfy"
+)
+
+// unifiedPushBackend forwards pushes, with their encrypted bodies as they were received,
+// to a topic on a UnifiedPush server, which is given as the device token. The server is
+// spoken to either as a web push service, as UnifiedPush servers are, or with the
+// headers of ntfy.
+type unifiedPushBackend struct {
+	baseURL  string
+	protocol string
+	token    string
+	client   *http.Client
+}
+
+// loadUnifiedPush sets up the UnifiedPush backend if UNIFIEDPUSH_URL is set.
+func loadUnifiedPush() {
+	baseURL := env("UNIFIEDPUSH_URL", "")
+	if baseURL == "" {
+		return
+	}
+
+	u := &unifiedPushBackend{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		protocol: env("UNIFIEDPUSH_PROTOCOL", unifiedPushWebPush),
+		token:    env("UNIFIEDPUSH_TOKEN", ""),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+
+	switch u.protocol {
+	case unifiedPushWebPush, unifiedPushNtfy:
+	default:
+		log.Fatalf("Unknown UNIFIEDPUSH_PROTOCOL %s\n", u.protocol)
+	}
+
+	backends[environmentUnifiedPush] = u
+
+	log.Println("Forwarding to UnifiedPush server", u.baseURL)
+}
+
+func (u *unifiedPushBackend) push(m *message) (*apns2.Response, error) {
+	body, err := m.body()
+	if err != nil {
+		return nil, err
+	}
+
+	address := u.baseURL + "/" + url.PathEscape(m.DeviceToken)
+	if u.protocol == unifiedPushNtfy {
+		address += "?up=1"
+	}
+
+	request, _ := http.NewRequest("POST", address, bytes.NewReader(body))
+
+	// The encryption parameters are in these headers for aesgcm, and in the body for
+	// aes128gcm.
+	for _, name := range []string{"Content-Encoding", "Crypto-Key", "Encryption"} {
+		if value := m.Headers.Get(name); value != "" {
+			request.Header.Set(name, value)
+		}
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	if u.token != "" {
+		request.Header.Set("Authorization", "Bearer "+u.token)
+	}
+
+	urgency := m.Headers.Get("Urgency")
+	if m.Silent || (urgency == "" && m.Priority == apns2.PriorityLow) {
+		urgency = "low"
+	}
+
+	ttl := -1
+	if !m.Expiration.IsZero() {
+		if ttl = int(time.Until(m.Expiration) / time.Second); ttl < 0 {
+			ttl = 0
+		}
+	}
+
+	switch u.protocol {
+	case unifiedPushNtfy:
+		// ntfy has priorities from 1 to 5 instead of urgencies, and can only be told not
+		// to keep a message for devices that are offline, rather than for how long. It
+		// has nothing like topics, as it does not replace messages. Its highest priority
+		// is for urgent alerts, with long vibration bursts, so high urgency is sent as 4.
+		priorities := map[string]string{"very-low": "1", "low": "2", "normal": "3", "high": "4"}
+		if priority, ok := priorities[urgency]; ok {
+			request.Header.Set("X-Priority", priority)
+		}
+		if ttl == 0 {
+			request.Header.Set("X-Cache", "no")
+		}
+	default:
+		if ttl >= 0 {
+			request.Header.Set("TTL", strconv.Itoa(ttl))
+		}
+		if urgency != "" {
+			request.Header.Set("Urgency", urgency)
+		}
+		if m.CollapseID != "" && !m.Silent {
+			request.Header.Set("Topic", m.CollapseID)
+		}
+	}
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		pushAttempts.Add("error", 1)
+		log.Println("UnifiedPush error:", err)
+		return nil, err
+	}
+	response.Body.Close()
+
+	res := &apns2.Response{StatusCode: response.StatusCode, ApnsID: m.ID}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		// Web push services accept pushes with 201, while APNs, and so Sent, uses 200.
+		res.StatusCode = 200
+		pushAttempts.Add("sent", 1)
+		log.Printf("Forwarded message %s to UnifiedPush topic %s -> %v\n", m.ID, m.DeviceToken, response.StatusCode)
+		return res, nil
+	}
+
+	res.Reason = httpStatusReason(response.StatusCode)
+	res.Timestamp.Time = time.Now()
+
+	pushAttempts.Add(res.Reason, 1)
+	log.Printf("Failed to forward message %s to UnifiedPush topic %s: %v %v\n", m.ID, m.DeviceToken, response.StatusCode, res.Reason)
+
+	return res, nil
+}
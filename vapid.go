@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// VAPID verification modes, as set by VAPID_MODE.
+const (
+	vapidOff     = "off"
+	vapidLog     = "log"
+	vapidEnforce = "enforce"
+)
+
+// RFC 8292 section 2 forbids expiration times more than 24 hours in the future.
+const maxVAPIDLifetime = 24 * time.Hour
+
+var (
+	vapidMode string
+	publicURL string
+)
+
+// vapidError is returned when VAPID verification fails, and carries the status code
+// that the push should be rejected with.
+type vapidError struct {
+	status  int
+	message string
+}
+
+func (e *vapidError) Error() string {
+	return e.message
+}
+
+func unauthorized(format string, a ...interface{}) error {
+	return &vapidError{status: 401, message: fmt.Sprintf(format, a...)}
+}
+
+// verifyVAPID checks the VAPID authorization of a request, as described in RFC 8292.
+// Both the current "vapid" scheme, and the older "WebPush" scheme with the key in
+// the Crypto-Key header are accepted. On success, the base64url encoded public key
+// of the application server is returned.
+func verifyVAPID(request *http.Request) (string, error) {
+	authorization := strings.TrimSpace(request.Header.Get("Authorization"))
+	if authorization == "" {
+		return "", unauthorized("Missing Authorization header")
+	}
+
+	scheme := authorization
+	parameters := ""
+	if index := strings.IndexByte(authorization, ' '); index >= 0 {
+		scheme = authorization[:index]
+		parameters = strings.TrimSpace(authorization[index+1:])
+	}
+
+	var token, key string
+	switch strings.ToLower(scheme) {
+	case "vapid":
+		keyValues := parseKeyValues(parameters)
+		token = keyValues["t"]
+		key = keyValues["k"]
+	case "webpush":
+		token = parameters
+		key = parseKeyValues(request.Header.Get("Crypto-Key"))["p256ecdsa"]
+	default:
+		return "", unauthorized("Unsupported authorization scheme %s", scheme)
+	}
+
+	if token == "" || key == "" {
+		return "", unauthorized("Missing VAPID token or key")
+	}
+
+	key = strings.TrimRight(key, "=")
+	publicKey, err := parseVAPIDKey(key)
+	if err != nil {
+		return "", unauthorized("Invalid VAPID key: %v", err)
+	}
+
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodES256.Alg()}}
+	parsed, err := parser.Parse(token, func(*jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	})
+	if err != nil {
+		return "", unauthorized("Invalid VAPID token: %v", err)
+	}
+
+	claims := parsed.Claims.(jwt.MapClaims)
+
+	expiration, ok := claims["exp"].(float64)
+	if !ok {
+		return "", unauthorized("VAPID token has no expiration time")
+	}
+
+	if time.Unix(int64(expiration), 0).After(time.Now().Add(maxVAPIDLifetime)) {
+		return "", unauthorized("VAPID token expires more than %v in the future", maxVAPIDLifetime)
+	}
+
+	audience, _ := claims["aud"].(string)
+	if expected := origin(request); strings.TrimRight(audience, "/") != expected {
+		return "", unauthorized("VAPID audience %s does not match %s", audience, expected)
+	}
+
+	return key, nil
+}
+
+// parseVAPIDKey decodes a base64url encoded uncompressed P-256 public key.
+func parseVAPIDKey(key string) (*ecdsa.PublicKey, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), bytes)
+	if x == nil {
+		return nil, errors.New("Not an uncompressed P-256 public key")
+	}
+
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// origin returns the origin the relay is reached at, which is what application servers
+// use as the audience of their VAPID tokens. PUBLIC_URL is used if set, as the request
+// itself does not reliably tell whether the sender used HTTPS when behind a proxy.
+func origin(request *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimRight(publicURL, "/")
+	}
+
+	scheme := "http"
+	if request.TLS != nil || request.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + request.Host
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func newVAPIDKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+}
+
+func signVAPID(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifyVAPID(t *testing.T) {
+	publicURL = "https://relay.example.com"
+	defer func() { publicURL = "" }()
+
+	key, public := newVAPIDKey(t)
+	otherKey, _ := newVAPIDKey(t)
+
+	valid := jwt.MapClaims{
+		"aud": "https://relay.example.com",
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": "mailto:admin@example.com",
+	}
+	claims := func(name string, value interface{}) jwt.MapClaims {
+		c := jwt.MapClaims{}
+		for n, v := range valid {
+			c[n] = v
+		}
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString([]byte(public))
+
+	tests := []struct {
+		name          string
+		authorization string
+		cryptoKey     string
+		valid         bool
+	}{
+		{"vapid scheme", "vapid t=" + signVAPID(t, key, valid) + ", k=" + public, "", true},
+		{"padded key", "vapid t=" + signVAPID(t, key, valid) + ", k=" + public + "=", "", true},
+		{"audience with slash", "vapid t=" + signVAPID(t, key, claims("aud", "https://relay.example.com/")) + ", k=" + public, "", true},
+		{"WebPush scheme", "WebPush " + signVAPID(t, key, valid), "dh=abc;p256ecdsa=" + public, true},
+		{"no authorization", "", "", false},
+		{"unsupported scheme", "Bearer " + signVAPID(t, key, valid), "", false},
+		{"no key", "vapid t=" + signVAPID(t, key, valid), "", false},
+		{"WebPush without key", "WebPush " + signVAPID(t, key, valid), "dh=abc", false},
+		{"invalid key", "vapid t=" + signVAPID(t, key, valid) + ", k=AAAA", "", false},
+		{"signed by another key", "vapid t=" + signVAPID(t, otherKey, valid) + ", k=" + public, "", false},
+		{"HMAC with the key", "vapid t=" + hmacToken + ", k=" + public, "", false},
+		{"no expiration", "vapid t=" + signVAPID(t, key, claims("exp", nil)) + ", k=" + public, "", false},
+		{"expired", "vapid t=" + signVAPID(t, key, claims("exp", time.Now().Add(-time.Minute).Unix())) + ", k=" + public, "", false},
+		{"expires too late", "vapid t=" + signVAPID(t, key, claims("exp", time.Now().Add(25*time.Hour).Unix())) + ", k=" + public, "", false},
+		{"wrong audience", "vapid t=" + signVAPID(t, key, claims("aud", "https://evil.example.com")) + ", k=" + public, "", false},
+		{"no audience", "vapid t=" + signVAPID(t, key, claims("aud", nil)) + ", k=" + public, "", false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/relay-to/production/token", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		if test.cryptoKey != "" {
+			request.Header.Set("Crypto-Key", test.cryptoKey)
+		}
+
+		got, err := verifyVAPID(request)
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.valid && got != public:
+			t.Errorf("%s: key = %q, want %q", test.name, got, public)
+		case !test.valid && err == nil:
+			t.Errorf("%s: accepted", test.name)
+		case !test.valid && err.(*vapidError).status != 401:
+			t.Errorf("%s: status = %d, want 401", test.name, err.(*vapidError).status)
+		}
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	request := httptest.NewRequest("POST", "/relay-to/production/token", nil)
+	request.Host = "relay.example.com"
+
+	if got := origin(request); got != "http://relay.example.com" {
+		t.Errorf("origin = %q, want http://relay.example.com", got)
+	}
+
+	request.Header.Set("X-Forwarded-Proto", "https")
+	if got := origin(request); got != "https://relay.example.com" {
+		t.Errorf("origin behind proxy = %q, want https://relay.example.com", got)
+	}
+
+	publicURL = "https://push.example.com/"
+	defer func() { publicURL = "" }()
+	if got := origin(request); got != "https://push.example.com" {
+		t.Errorf("origin with PUBLIC_URL = %q, want https://push.example.com", got)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// webhookBackend delivers pushes as JSON to a webhook, for services of your own. The
+// device token is passed on, for the service to tell recipients apart by.
+type webhookBackend struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// webhookPayload is the body of a request to a webhook.
+type webhookPayload struct {
+	ID    string `json:"id"`
+	App   string `json:"app,omitempty"`
+	Token string `json:"token"`
+
+	// Fields are the same as those of a notification, as described in the README, but
+	// with the whole encoded body in p, as there is no need to offload or split it.
+	Fields map[string]string `json:"fields"`
+
+	TTL      *int      `json:"ttl,omitempty"`
+	Urgency  string    `json:"urgency"`
+	Topic    string    `json:"topic,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// loadWebhook sets up the webhook backend if WEBHOOK_URL is set.
+func loadWebhook() {
+	address := env("WEBHOOK_URL", "")
+	if address == "" {
+		return
+	}
+
+	backends[environmentWebhook] = &webhookBackend{
+		url:    address,
+		secret: []byte(env("WEBHOOK_SECRET", "")),
+		client: &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+	}
+
+	log.Println("Delivering to webhook", address)
+}
+
+func (w *webhookBackend) push(m *message) (*apns2.Response, error) {
+	fields, err := m.wholeFields()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &webhookPayload{
+		ID:       m.ID,
+		App:      m.App,
+		Token:    m.DeviceToken,
+		Fields:   fields,
+		Urgency:  m.Headers.Get("Urgency"),
+		Topic:    m.CollapseID,
+		Received: m.Received,
+	}
+
+	if payload.Urgency == "" {
+		payload.Urgency = "normal"
+		if m.Priority == apns2.PriorityLow {
+			payload.Urgency = "low"
+		}
+	}
+
+	if !m.Expiration.IsZero() {
+		ttl := int(time.Until(m.Expiration) / time.Second)
+		if ttl < 0 {
+			ttl = 0
+		}
+		payload.TTL = &ttl
+	}
+
+	body, _ := json.Marshal(payload)
+
+	request, _ := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	// The signature covers the time it was made, so that the webhook can reject old
+	// requests that are replayed.
+	if len(w.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+
+		request.Header.Set("X-Toot-Relay-Timestamp", timestamp)
+		request.Header.Set("X-Toot-Relay-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		pushAttempts.Add("error", 1)
+		log.Println("Webhook error:", err)
+		return nil, err
+	}
+	response.Body.Close()
+
+	res := &apns2.Response{StatusCode: response.StatusCode, ApnsID: m.ID}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		res.StatusCode = 200
+		pushAttempts.Add("sent", 1)
+		log.Printf("Delivered message %s to webhook for %s -> %v\n", m.ID, m.DeviceToken, response.StatusCode)
+		return res, nil
+	}
+
+	// Only 410 means that the recipient is gone, as 404 more likely means that the
+	// webhook is misconfigured.
+	res.Reason = httpStatusReason(response.StatusCode)
+	if response.StatusCode == 404 {
+		res.Reason = apns2.ReasonBadPath
+	}
+	res.Timestamp.Time = time.Now()
+
+	pushAttempts.Add(res.Reason, 1)
+	log.Printf("Failed to deliver message %s to webhook for %s: %v %v\n", m.ID, m.DeviceToken, response.StatusCode, res.Reason)
+
+	return res, nil
+}